@@ -0,0 +1,221 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"turnstile/internal/access"
+	"turnstile/internal/auth"
+	"turnstile/internal/config"
+	"turnstile/internal/csrf"
+	"turnstile/internal/health"
+	"turnstile/internal/httpx"
+	"turnstile/internal/i18n"
+	"turnstile/internal/oauth"
+	"turnstile/internal/proxy"
+	"turnstile/internal/railway"
+	"turnstile/internal/ratelimit"
+	"turnstile/internal/session"
+	"turnstile/internal/static"
+	"turnstile/internal/views"
+)
+
+// shared holds the state that must survive config reloads, such as sessions.
+type shared struct {
+	sessions *session.Manager
+	railway  *railway.Client
+}
+
+// app is the request handler built from one version of the config. On reload
+// a new app is built and swapped in; the old one is closed once replaced.
+type app struct {
+	cfg     *config.Config
+	handler http.Handler
+	closers []io.Closer
+}
+
+func newApp(cfg *config.Config, deps *shared) (_ *app, err error) {
+	a := &app{cfg: cfg}
+	// Validate rejects route paths ServeMux would panic on, but should one
+	// slip through, a reload must fail rather than take the server down.
+	defer func() {
+		if p := recover(); p != nil {
+			a.Close()
+			err = fmt.Errorf("build handler: %v", p)
+		}
+	}()
+
+	brand := views.Brand{
+		AppName:    cfg.DisplayName(),
+		LogoURL:    cfg.BrandLogoURL,
+		Color:      cfg.BrandColor,
+		SupportURL: cfg.SupportURL(),
+	}
+	var templateDir, staticDir string
+	if cfg.ThemeDir != "" {
+		templateDir = filepath.Join(cfg.ThemeDir, "templates")
+		staticDir = filepath.Join(cfg.ThemeDir, "static")
+	}
+	messages, err := i18n.NewBundle(cfg.DefaultLanguage)
+	if err != nil {
+		return nil, fmt.Errorf("load message catalogs: %w", err)
+	}
+	renderer, err := views.NewRenderer(cfg.AuthPrefix+"/static", brand, templateDir, messages)
+	if err != nil {
+		return nil, fmt.Errorf("load view templates: %w", err)
+	}
+
+	oauthHandler := oauth.NewHandler(cfg, deps.sessions, deps.railway, renderer)
+	// Unauthenticated browsers go to the sign-in page if enabled, otherwise
+	// straight to Railway.
+	signInPath := cfg.URI(config.RouteLogin, config.PathOnly)
+	if cfg.SignInPage {
+		signInPath = cfg.URI(config.RouteSignIn, config.PathOnly)
+	}
+	authMiddleware := auth.NewMiddleware(deps.sessions, signInPath, cfg.DisplayName(), renderer)
+
+	// One cache for every proxy, so its size limit holds across routes.
+	cache, err := proxy.NewCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		a.closers = append(a.closers, cache)
+	}
+
+	proxyHandler, err := proxy.NewHandler(cfg, renderer, cache)
+	if err != nil {
+		a.Close()
+		return nil, fmt.Errorf("create proxy handler: %w", err)
+	}
+	a.closers = append(a.closers, proxyHandler)
+
+	limiter, err := ratelimit.New(cfg.RateLimitRedisURL, renderer)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	a.closers = append(a.closers, limiter)
+	limitAuth := limiter.Middleware("auth", ratelimit.PerPeriod(cfg.AuthRateLimit, cfg.AuthRateLimitPeriod), ratelimit.ByIP)
+
+	csrfProtector := csrf.New(deps.sessions, cfg.PublicURL, renderer)
+	policy := access.NewPolicy(config.Networks(cfg.IPAllowlist), config.Networks(cfg.IPDenylist), config.Networks(cfg.TrustedNetworks), renderer)
+
+	readiness := health.NewChecker(cfg.ReadyCacheTTL, 10*time.Second)
+	readiness.Add("backend", proxyHandler.ReadinessCheck(cfg.ReadyPath, cfg.ReadyExpectedStatus))
+	readiness.AddStatus("circuit_breaker", proxyHandler.BreakerStatus)
+	readiness.Add("session_store", deps.sessions.Ping)
+	readiness.Add("railway_oauth", oauthHandler.Ping)
+	readiness.Add("railway_api", deps.railway.Ping)
+	if cfg.RateLimitRedisURL != "" {
+		readiness.Add("rate_limit_store", limiter.Ping)
+	}
+
+	mux := http.NewServeMux()
+
+	if cfg.SignInPage {
+		mux.Handle(cfg.URI(config.RouteSignIn, config.PathOnly), policy.Restrict(http.HandlerFunc(oauthHandler.SignInHandler)))
+	}
+	// Each callback costs several Railway API calls, so sign-in is limited
+	// per client IP.
+	mux.Handle(cfg.URI(config.RouteLogin, config.PathOnly), policy.Restrict(limitAuth(http.HandlerFunc(oauthHandler.LoginHandler))))
+	mux.Handle(cfg.URI(config.RouteRefresh, config.PathOnly), policy.Restrict(limitAuth(http.HandlerFunc(oauthHandler.RefreshHandler))))
+	mux.Handle(cfg.URI(config.RouteCallback, config.PathOnly), policy.Restrict(limitAuth(http.HandlerFunc(oauthHandler.CallbackHandler))))
+	mux.Handle(cfg.URI(config.RouteSession, config.PathOnly), policy.Restrict(http.HandlerFunc(oauthHandler.SessionHandler)))
+	mux.Handle(cfg.URI(config.RouteMe, config.PathOnly), policy.Restrict(authMiddleware.RequireAuth(http.HandlerFunc(oauthHandler.MeHandler))))
+	mux.Handle(cfg.URI(config.RouteLogout, config.PathOnly), policy.Restrict(csrfProtector.ProtectSession(http.HandlerFunc(oauthHandler.LogoutHandler))))
+
+	mux.HandleFunc(cfg.URI(config.RouteHealth, config.PathOnly), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	mux.Handle(cfg.URI(config.RouteReady, config.PathOnly), readiness)
+
+	staticPrefix := cfg.AuthPrefix + "/static/"
+	mux.Handle(staticPrefix, http.StripPrefix(staticPrefix, static.Handler(staticDir)))
+
+	mux.HandleFunc(cfg.URI(config.RouteCatchAll, config.PathOnly), func(w http.ResponseWriter, r *http.Request) {
+		renderer.RenderNotFoundPage(w, r, views.NotFoundPageData{
+			AuthPrefix: cfg.AuthPrefix,
+			LoginURL:   cfg.URI(config.RouteLogin, config.PathOnly),
+			LogoutURL:  cfg.URI(config.RouteLogout, config.PathOnly),
+			MeURL:      cfg.URI(config.RouteMe, config.PathOnly),
+			SessionURL: cfg.URI(config.RouteSession, config.PathOnly),
+			HealthURL:  cfg.URI(config.RouteHealth, config.PathOnly),
+			ReadyURL:   cfg.URI(config.RouteReady, config.PathOnly),
+		})
+	})
+
+	// Routes with their own backends get a dedicated proxy; the rest share
+	// the default one.
+	for _, route := range cfg.Routes {
+		routeHandler := proxyHandler
+		if len(route.BackendURLs) > 0 {
+			routeCfg := *cfg
+			routeCfg.BackendURLs = route.BackendURLs
+			routeCfg.Upstream = cfg.Upstream.Merge(route.Upstream)
+			routeProxy, err := proxy.NewHandler(&routeCfg, renderer, cache)
+			if err != nil {
+				a.Close()
+				return nil, fmt.Errorf("create proxy handler for route %s: %w", route.Path, err)
+			}
+			a.closers = append(a.closers, routeProxy)
+			readiness.Add("backend "+route.Path, routeProxy.ReadinessCheck(cfg.ReadyPath, cfg.ReadyExpectedStatus))
+			routeHandler = routeProxy
+		}
+
+		limit := ratelimit.PerPeriod(cmp.Or(route.RateLimit, cfg.RateLimit), cmp.Or(route.RateLimitPeriod, cfg.RateLimitPeriod))
+		handler := limiter.Middleware("route "+route.Path, limit, ratelimit.ByUser)(routeHandler.ForRoute(route))
+
+		routePolicy := access.NewPolicy(
+			config.Networks(orDefault(route.IPAllowlist, cfg.IPAllowlist)),
+			config.Networks(orDefault(route.IPDenylist, cfg.IPDenylist)),
+			config.Networks(orDefault(route.TrustedNetworks, cfg.TrustedNetworks)),
+			renderer,
+		)
+		if route.Public {
+			handler = routePolicy.Restrict(handler)
+		} else {
+			handler = routePolicy.Guard(handler, authMiddleware.RequireAuth(handler))
+		}
+		mux.Handle(route.Path, handler)
+	}
+
+	limit := ratelimit.PerPeriod(cfg.RateLimit, cfg.RateLimitPeriod)
+	handler := limiter.Middleware("proxy", limit, ratelimit.ByUser)(proxyHandler)
+	mux.Handle("/", policy.Guard(handler, authMiddleware.RequireAuth(handler)))
+
+	ips := httpx.NewIPResolver(config.Networks(cfg.TrustedProxies), cfg.TrustsAnyProxy())
+	api := httpx.NewAPIDetector(cfg.APIPaths, cfg.APIHeaders, cfg.APIFetchModes)
+	a.handler = ips.Middleware(api.Middleware(mux))
+	return a, nil
+}
+
+// orDefault returns a route's list if set, otherwise the top-level one.
+func orDefault(route, top []string) []string {
+	if len(route) > 0 {
+		return route
+	}
+	return top
+}
+
+func (a *app) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.ServeHTTP(w, r)
+}
+
+// Close stops the app's background work (health checks, DNS discovery).
+// Requests already in flight are unaffected.
+func (a *app) Close() error {
+	var errs []error
+	for _, c := range a.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
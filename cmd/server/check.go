@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+
+	"turnstile/internal/config"
+)
+
+// checkConfig implements `turnstile check-config`: it loads and validates the
+// configuration exactly as the server would, then prints the effective
+// config with secrets redacted. It returns the process exit code.
+func checkConfig(stdout, stderr io.Writer) int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(stderr, "Configuration is invalid:\n%v\n", err)
+		return 1
+	}
+
+	fmt.Fprintln(stdout, "# Configuration is valid.")
+	if cfg.File != "" {
+		fmt.Fprintf(stdout, "# Config file: %s\n", cfg.File)
+	}
+	fmt.Fprintf(stdout, "# OAuth redirect URI: %s\n", cfg.URI(config.RouteCallback, config.FullURL))
+	fmt.Fprintln(stdout, "# Effective configuration (secrets redacted):")
+
+	enc := yaml.NewEncoder(stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(stderr, "Failed to print configuration: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"turnstile/internal/config"
+	"turnstile/internal/httpx"
+)
+
+// listen serves handler on the configured port, over TLS when a certificate
+// is configured, plus the optional plain-HTTP redirect listener. It blocks
+// until the main server fails.
+func listen(cfg *config.Config, handler http.Handler, certs *httpx.CertLoader) error {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: handler,
+	}
+
+	if !cfg.TLSEnabled() {
+		slog.Info("Starting server", "addr", server.Addr, "config_file", cfg.File)
+		return server.ListenAndServe()
+	}
+
+	if cfg.HTTPRedirectPort != 0 {
+		redirect := &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.HTTPRedirectPort),
+			Handler: redirectToHTTPS(cfg.PublicURL),
+		}
+		go func() {
+			slog.Info("Starting HTTP redirect server", "addr", redirect.Addr)
+			if err := redirect.ListenAndServe(); err != nil {
+				slog.Error("HTTP redirect server failed", "error", err)
+			}
+		}()
+	}
+
+	server.TLSConfig = httpx.ServerTLSConfig(cfg, certs)
+	slog.Info("Starting server", "addr", server.Addr, "config_file", cfg.File, "tls", true,
+		"tls_min_version", cfg.TLSMinVersion, "tls_cipher_policy", cfg.TLSCipherPolicy)
+	// The certificate comes from TLSConfig.GetCertificate.
+	return server.ListenAndServeTLS("", "")
+}
+
+// redirectToHTTPS permanently redirects every request to the same path on
+// the public HTTPS URL.
+func redirectToHTTPS(publicURL string) http.Handler {
+	base := strings.TrimSuffix(publicURL, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, base+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// listenerChanged reports whether settings that only take effect on restart
+// differ between two configs.
+func listenerChanged(a, b *config.Config) bool {
+	return a.Port != b.Port ||
+		a.TLSEnabled() != b.TLSEnabled() ||
+		a.TLSMinVersion != b.TLSMinVersion ||
+		a.TLSCipherPolicy != b.TLSCipherPolicy ||
+		a.HTTPRedirectPort != b.HTTPRedirectPort
+}
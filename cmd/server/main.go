@@ -1,79 +1,132 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 
-	"turnstile/internal/auth"
 	"turnstile/internal/config"
 	"turnstile/internal/httpx"
-	"turnstile/internal/oauth"
 	"turnstile/internal/proxy"
 	"turnstile/internal/railway"
 	"turnstile/internal/session"
-	"turnstile/internal/static"
-	"turnstile/internal/views"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-config":
+			os.Exit(checkConfig(os.Stdout, os.Stderr))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\nusage: %s [check-config]\n", os.Args[1], os.Args[0])
+			os.Exit(2)
+		}
+	}
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(httpx.ParseLogLevel(cfg.LogLevel))
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: httpx.ParseLogLevel(cfg.LogLevel),
+		Level: logLevel,
 	})))
 
-	sessionManager := session.NewManager()
+	warnUntrustedIPs(cfg)
 
-	renderer, err := views.NewRenderer(cfg.AuthPrefix + "/static")
-	if err != nil {
-		log.Fatalf("Failed to load view templates: %v", err)
+	deps := &shared{
+		sessions: session.NewManager(),
+		railway:  railway.NewClient(nil),
 	}
 
-	railwayClient := railway.NewClient(nil)
-	oauthHandler := oauth.NewHandler(cfg, sessionManager, railwayClient, renderer)
-	authMiddleware := auth.NewMiddleware(sessionManager, cfg.URI(config.RouteLogin, config.PathOnly))
+	if cfg.Cache && cfg.CacheDir != "" {
+		proxy.ClearCacheDir(cfg.CacheDir)
+	}
 
-	proxyHandler, err := proxy.NewHandler(cfg.BackendURL, cfg.ProxyMaxRetries, cfg.ProxyRetryDelay)
+	initial, err := newApp(cfg, deps)
 	if err != nil {
-		log.Fatalf("Failed to create proxy handler: %v", err)
+		log.Fatalf("Failed to start: %v", err)
 	}
 
-	mux := http.NewServeMux()
-
-	mux.HandleFunc(cfg.URI(config.RouteLogin, config.PathOnly), oauthHandler.LoginHandler)
-	mux.HandleFunc(cfg.URI(config.RouteCallback, config.PathOnly), oauthHandler.CallbackHandler)
-	mux.HandleFunc(cfg.URI(config.RouteLogout, config.PathOnly), oauthHandler.LogoutHandler)
+	var certs *httpx.CertLoader
+	if cfg.TLSEnabled() {
+		certs, err = httpx.NewCertLoader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to start: %v", err)
+		}
+	}
 
-	mux.HandleFunc(cfg.URI(config.RouteHealth, config.PathOnly), func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	})
+	var current atomic.Pointer[app]
+	current.Store(initial)
+
+	// Reload on SIGHUP or config file changes: build a complete new app from
+	// the new config and atomically swap it in, so in-flight requests finish
+	// on the old one and no connections are dropped. If the new config is
+	// invalid, keep serving the old one.
+	var reloadMu sync.Mutex
+	reload := func() {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		next, err := config.Load()
+		if err != nil {
+			slog.Error("config reload failed, keeping current config", "error", err)
+			return
+		}
+
+		nextApp, err := newApp(next, deps)
+		if err != nil {
+			slog.Error("config reload failed, keeping current config", "error", err)
+			return
+		}
+
+		// Certificates are swapped in place; other listener settings need
+		// a restart.
+		if certs != nil && next.TLSEnabled() {
+			if err := certs.Reload(next.TLSCertFile, next.TLSKeyFile); err != nil {
+				nextApp.Close()
+				slog.Error("config reload failed, keeping current config", "error", err)
+				return
+			}
+		}
+		if listenerChanged(current.Load().cfg, next) {
+			slog.Warn("listener settings changed; restart Turnstile to apply them",
+				"port", next.Port, "tls", next.TLSEnabled(), "http_redirect_port", next.HTTPRedirectPort)
+		}
+
+		warnUntrustedIPs(next)
+		logLevel.Set(httpx.ParseLogLevel(next.LogLevel))
+		previous := current.Swap(nextApp)
+		previous.Close()
+		slog.Info("config reloaded", "file", next.File, "routes", len(next.Routes))
+	}
 
-	staticPrefix := cfg.AuthPrefix + "/static/"
-	mux.Handle(staticPrefix, http.StripPrefix(staticPrefix, http.FileServer(http.FS(static.FS))))
+	go config.Watch(context.Background(), func() []string {
+		return current.Load().cfg.WatchPaths()
+	}, reload)
 
-	mux.HandleFunc(cfg.URI(config.RouteCatchAll, config.PathOnly), func(w http.ResponseWriter, r *http.Request) {
-		renderer.RenderNotFoundPage(w, views.NotFoundPageData{
-			AuthPrefix: cfg.AuthPrefix,
-			LoginURL:   cfg.URI(config.RouteLogin, config.PathOnly),
-			LogoutURL:  cfg.URI(config.RouteLogout, config.PathOnly),
-			HealthURL:  cfg.URI(config.RouteHealth, config.PathOnly),
-		})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current.Load().ServeHTTP(w, r)
 	})
 
-	mux.Handle("/", authMiddleware.RequireAuth(proxyHandler))
-
-	addr := fmt.Sprintf(":%d", cfg.Port)
-	slog.Info("Starting server", "addr", addr)
-
-	if err := http.ListenAndServe(addr, httpx.LoggingMiddleware(mux)); err != nil {
+	if err := listen(cfg, httpx.RequestID(httpx.LoggingMiddleware(handler)), certs); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
+
+// warnUntrustedIPs warns about IP-based settings that can't work as intended
+// because no proxy is trusted: behind Railway's edge they'd only ever see
+// the edge's address.
+func warnUntrustedIPs(cfg *config.Config) {
+	if keys := cfg.UntrustedIPSettings(); len(keys) > 0 {
+		slog.Warn("client IPs aren't resolved because trusted_proxies is empty; behind a proxy these settings only see its address",
+			"settings", keys, "hint", "set TURNSTILE_TRUSTED_PROXIES=* on Railway")
+	}
+}
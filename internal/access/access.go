@@ -0,0 +1,77 @@
+// Package access restricts handlers by client IP address.
+package access
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+
+	"turnstile/internal/httpx"
+	"turnstile/internal/problem"
+	"turnstile/internal/views"
+)
+
+// Policy admits or rejects clients by network. The denylist is checked
+// first, then the allowlist (if any); admitted clients from trusted networks
+// skip sign-in.
+type Policy struct {
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+	trusted  []netip.Prefix
+	problems *problem.Writer
+}
+
+func NewPolicy(allow, deny, trusted []netip.Prefix, renderer *views.Renderer) *Policy {
+	return &Policy{allow: allow, deny: deny, trusted: trusted, problems: problem.NewWriter(renderer)}
+}
+
+// Guard rejects clients the policy doesn't admit with 403, serves clients
+// from trusted networks with open, and everyone else with protected.
+func (p *Policy) Guard(open, protected http.Handler) http.Handler {
+	if len(p.allow) == 0 && len(p.deny) == 0 && len(p.trusted) == 0 {
+		return protected
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := httpx.ClientAddr(r)
+		switch {
+		case !p.admits(addr):
+			p.serveForbidden(w, r, addr)
+		case contains(p.trusted, addr):
+			open.ServeHTTP(w, r)
+		default:
+			protected.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Restrict rejects clients the policy doesn't admit with 403.
+func (p *Policy) Restrict(next http.Handler) http.Handler {
+	return p.Guard(next, next)
+}
+
+func (p *Policy) admits(addr netip.Addr) bool {
+	if contains(p.deny, addr) {
+		return false
+	}
+	return len(p.allow) == 0 || contains(p.allow, addr)
+}
+
+func (p *Policy) serveForbidden(w http.ResponseWriter, r *http.Request, addr netip.Addr) {
+	slog.Warn("client IP not allowed", "path", r.URL.Path, "client_ip", addr.String())
+
+	p.problems.Write(w, r, problem.Details{
+		Status: http.StatusForbidden,
+		Code:   "ip_not_allowed",
+		Detail: "access.denied",
+		Note:   "access.denied_note",
+	})
+}
+
+func contains(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range networks {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,45 +1,48 @@
 package auth
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 
 	"turnstile/internal/httpx"
+	"turnstile/internal/problem"
 	"turnstile/internal/session"
+	"turnstile/internal/views"
 )
 
 type Middleware struct {
 	session   *session.Manager
 	loginPath string
+	realm     string
+	problems  *problem.Writer
 }
 
-func NewMiddleware(sessionManager *session.Manager, loginPath string) *Middleware {
-	return &Middleware{session: sessionManager, loginPath: loginPath}
+// NewMiddleware returns a middleware that sends unauthenticated browsers to
+// loginPath. API clients get a 401 naming realm (the app's name) instead.
+func NewMiddleware(sessionManager *session.Manager, loginPath, realm string, renderer *views.Renderer) *Middleware {
+	return &Middleware{session: sessionManager, loginPath: loginPath, realm: realm, problems: problem.NewWriter(renderer)}
 }
 
 func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sess, err := m.session.GetSession(r)
 		if err != nil {
-			httpx.WriteJSONError(w, "session_error", "Invalid session. Please log in again.", http.StatusUnauthorized)
+			m.unauthorized(w, r, "session_error", "auth.invalid_session")
 			return
 		}
 
 		if sess == nil {
 
 			// if this is an API request, don't redirect, just 401
-			if isAPIRequest(r) {
-				httpx.WriteJSONError(w, "unauthorized", "Session expired. Please log in again.", http.StatusUnauthorized)
+			if httpx.IsAPIRequest(r) {
+				m.unauthorized(w, r, "unauthorized", "auth.session_expired")
 				return
 			}
 
 			// if not an API request, redirect the user and log them in
-			loginURL := m.loginPath
-			if r.URL.Path != "/" {
-				loginURL += "?redirect=" + url.QueryEscape(r.URL.RequestURI())
-			}
-			http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+			http.Redirect(w, r, m.loginURL(r.URL.RequestURI()), http.StatusTemporaryRedirect)
 			return
 		}
 
@@ -48,9 +51,38 @@ func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
 	})
 }
 
-// try to be smart and determine if this is an API request
-func isAPIRequest(r *http.Request) bool {
-	return strings.HasPrefix(r.URL.Path, "/api/") ||
-		r.Header.Get("Accept") == "application/json" ||
-		r.Header.Get("Content-Type") == "application/json"
+// unauthorized sends a 401 telling the client how to sign in. A script can't
+// follow the OAuth redirects itself, so the login URL returns the user to the
+// page that made the request.
+func (m *Middleware) unauthorized(w http.ResponseWriter, r *http.Request, code, detail string) {
+	loginURL := m.loginURL(refererPath(r))
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Turnstile realm=%s, login_url=%s", quote(m.realm), quote(loginURL)))
+	m.problems.Write(w, r, problem.Details{
+		Status:   http.StatusUnauthorized,
+		Code:     code,
+		Detail:   detail,
+		LoginURL: loginURL,
+	})
+}
+
+// loginURL returns the login path, redirecting back to returnTo afterwards.
+func (m *Middleware) loginURL(returnTo string) string {
+	if returnTo == "" || returnTo == "/" {
+		return m.loginPath
+	}
+	return m.loginPath + "?redirect=" + url.QueryEscape(returnTo)
+}
+
+// refererPath returns the path and query of a same-origin Referer, or "".
+func refererPath(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || ref.Host != r.Host {
+		return ""
+	}
+	return ref.RequestURI()
+}
+
+// quote returns s as an HTTP quoted-string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
 }
@@ -1,108 +1,829 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
-	"strconv"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
+
+	"turnstile/internal/i18n"
 )
 
+// Config is Turnstile's runtime configuration. Every field can be set in the
+// optional config file by its yaml key; fields with an env tag can also be set
+// by that environment variable, which takes precedence over the file.
 type Config struct {
-	RailwayClientID     string
-	RailwayClientSecret string
-	RailwayProjectID    string
-	BackendURL          string
-	PublicURL           string
-	Port                int
-	AuthPrefix          string
-	LogLevel            string
-	ProxyMaxRetries     int
-	ProxyRetryDelay     time.Duration
+	RailwayClientID       string        `yaml:"railway_client_id" env:"RAILWAY_CLIENT_ID"`
+	RailwayClientSecret   string        `yaml:"railway_client_secret" env:"RAILWAY_CLIENT_SECRET" secret:"true"`
+	RailwayProjectID      string        `yaml:"railway_project_id" env:"RAILWAY_PROJECT_ID"`
+	BackendURLs           []string      `yaml:"backend_urls" env:"TURNSTILE_BACKEND_URL"`
+	PublicURL             string        `yaml:"public_url" env:"TURNSTILE_PUBLIC_URL"`
+	Port                  int           `yaml:"port" env:"PORT"`
+	AuthPrefix            string        `yaml:"auth_prefix" env:"TURNSTILE_AUTH_PREFIX"`
+	LogLevel              string        `yaml:"log_level" env:"TURNSTILE_LOG_LEVEL"`
+	ProxyMaxRetries       int           `yaml:"proxy_max_retries" env:"TURNSTILE_PROXY_MAX_RETRIES"`
+	ProxyRetryDelay       time.Duration `yaml:"proxy_retry_delay" env:"TURNSTILE_PROXY_RETRY_DELAY"`
+	ProxyRetryStatusCodes []int         `yaml:"proxy_retry_status_codes" env:"TURNSTILE_PROXY_RETRY_STATUS_CODES"`
+	ProxyRetryBudget      time.Duration `yaml:"proxy_retry_budget" env:"TURNSTILE_PROXY_RETRY_BUDGET"`
+	ReadyPath             string        `yaml:"ready_path" env:"TURNSTILE_READY_PATH"`
+	ReadyExpectedStatus   int           `yaml:"ready_expected_status" env:"TURNSTILE_READY_EXPECTED_STATUS"`
+	ReadyCacheTTL         time.Duration `yaml:"ready_cache_ttl" env:"TURNSTILE_READY_CACHE_TTL"`
+
+	HealthCheckInterval  time.Duration `yaml:"health_check_interval" env:"TURNSTILE_HEALTH_CHECK_INTERVAL"`
+	HealthCheckPath      string        `yaml:"health_check_path" env:"TURNSTILE_HEALTH_CHECK_PATH"`
+	HealthCheckTimeout   time.Duration `yaml:"health_check_timeout" env:"TURNSTILE_HEALTH_CHECK_TIMEOUT"`
+	HealthCheckThreshold int           `yaml:"health_check_threshold" env:"TURNSTILE_HEALTH_CHECK_THRESHOLD"`
+
+	BackendDiscovery         string        `yaml:"backend_discovery" env:"TURNSTILE_BACKEND_DISCOVERY"`
+	BackendDiscoveryInterval time.Duration `yaml:"backend_discovery_interval" env:"TURNSTILE_BACKEND_DISCOVERY_INTERVAL"`
+	LBStrategy               string        `yaml:"lb_strategy" env:"TURNSTILE_LB_STRATEGY"`
+	LBEjectThreshold         int           `yaml:"lb_eject_threshold" env:"TURNSTILE_LB_EJECT_THRESHOLD"`
+	LBEjectDuration          time.Duration `yaml:"lb_eject_duration" env:"TURNSTILE_LB_EJECT_DURATION"`
+
+	BreakerFailureThreshold int           `yaml:"breaker_failure_threshold" env:"TURNSTILE_BREAKER_FAILURE_THRESHOLD"`
+	BreakerSuccessThreshold int           `yaml:"breaker_success_threshold" env:"TURNSTILE_BREAKER_SUCCESS_THRESHOLD"`
+	BreakerCooldown         time.Duration `yaml:"breaker_cooldown" env:"TURNSTILE_BREAKER_COOLDOWN"`
+
+	Upstream `yaml:",inline"`
+
+	// StripPrefix is removed from, and AddPrefix prepended to, the path of
+	// every proxied request. Redirects and cookie paths from the backend are
+	// mapped back.
+	StripPrefix string `yaml:"strip_prefix" env:"TURNSTILE_STRIP_PREFIX"`
+	AddPrefix   string `yaml:"add_prefix" env:"TURNSTILE_ADD_PREFIX"`
+
+	// MaxRequestBodySize limits request bodies, in bytes; 0 is unlimited.
+	// UpstreamTimeout bounds each proxied request, and StreamingTimeout
+	// replaces it for SSE and WebSocket requests; 0 means no limit.
+	MaxRequestBodySize int           `yaml:"max_request_body_size" env:"TURNSTILE_MAX_REQUEST_BODY_SIZE"`
+	UpstreamTimeout    time.Duration `yaml:"upstream_timeout" env:"TURNSTILE_UPSTREAM_TIMEOUT"`
+	StreamingTimeout   time.Duration `yaml:"streaming_timeout" env:"TURNSTILE_STREAMING_TIMEOUT"`
+
+	Compression          bool     `yaml:"compression" env:"TURNSTILE_COMPRESSION"`
+	CompressionEncodings []string `yaml:"compression_encodings" env:"TURNSTILE_COMPRESSION_ENCODINGS"`
+	CompressionMinSize   int      `yaml:"compression_min_size" env:"TURNSTILE_COMPRESSION_MIN_SIZE"`
+	CompressionTypes     []string `yaml:"compression_types" env:"TURNSTILE_COMPRESSION_TYPES"`
+
+	Cache              bool   `yaml:"cache" env:"TURNSTILE_CACHE"`
+	CacheMaxSize       int    `yaml:"cache_max_size" env:"TURNSTILE_CACHE_MAX_SIZE"`
+	CacheMaxObjectSize int    `yaml:"cache_max_object_size" env:"TURNSTILE_CACHE_MAX_OBJECT_SIZE"`
+	CacheDir           string `yaml:"cache_dir" env:"TURNSTILE_CACHE_DIR"`
+
+	// AuthRateLimit limits sign-in requests per client IP, and RateLimit
+	// proxied requests per user, to that many per period; 0 disables the
+	// limit. RateLimitRedisURL shares the limits between replicas.
+	AuthRateLimit       int           `yaml:"auth_rate_limit" env:"TURNSTILE_AUTH_RATE_LIMIT"`
+	AuthRateLimitPeriod time.Duration `yaml:"auth_rate_limit_period" env:"TURNSTILE_AUTH_RATE_LIMIT_PERIOD"`
+	RateLimit           int           `yaml:"rate_limit" env:"TURNSTILE_RATE_LIMIT"`
+	RateLimitPeriod     time.Duration `yaml:"rate_limit_period" env:"TURNSTILE_RATE_LIMIT_PERIOD"`
+	RateLimitRedisURL   string        `yaml:"rate_limit_redis_url" env:"TURNSTILE_RATE_LIMIT_REDIS_URL" secret:"true"`
+
+	// RequestHeaders modify requests sent to the backend; ResponseHeaders
+	// modify the backend's responses. They can only be set in the config
+	// file.
+	RequestHeaders  HeaderRules `yaml:"request_headers"`
+	ResponseHeaders HeaderRules `yaml:"response_headers"`
+
+	// SignInPage shows a page explaining what's protected, with a button to
+	// continue to Railway, instead of redirecting straight to Railway's
+	// OAuth screen. AppName is the protected app's name shown on Turnstile's
+	// pages; it defaults to the public URL's host.
+	SignInPage bool   `yaml:"sign_in_page" env:"TURNSTILE_SIGN_IN_PAGE"`
+	AppName    string `yaml:"app_name" env:"TURNSTILE_APP_NAME"`
+
+	// ThemeDir customizes Turnstile's pages: templates/*.html replace the
+	// built-in templates of the same name, and files in static/ are served
+	// before the built-in assets. BrandLogoURL, BrandColor and
+	// SupportContact (an email address or URL) customize the built-in
+	// templates.
+	ThemeDir       string `yaml:"theme_dir" env:"TURNSTILE_THEME_DIR"`
+	BrandLogoURL   string `yaml:"brand_logo_url" env:"TURNSTILE_BRAND_LOGO_URL"`
+	BrandColor     string `yaml:"brand_color" env:"TURNSTILE_BRAND_COLOR"`
+	SupportContact string `yaml:"support_contact" env:"TURNSTILE_SUPPORT_CONTACT"`
+
+	// DefaultLanguage is the language of Turnstile's pages and error
+	// messages for clients whose Accept-Language names none of the
+	// translations.
+	DefaultLanguage string `yaml:"default_language" env:"TURNSTILE_DEFAULT_LANGUAGE"`
+
+	// Requests are treated as API requests, which get a 401 instead of a
+	// redirect to sign in, when their path matches one of APIPaths (a
+	// trailing slash matches the whole subtree; * matches within a segment),
+	// they carry one of APIHeaders ("Name" or "Name: value"), their
+	// Sec-Fetch-Mode is one of APIFetchModes, or they prefer JSON.
+	APIPaths      []string `yaml:"api_paths" env:"TURNSTILE_API_PATHS"`
+	APIHeaders    []string `yaml:"api_headers" env:"TURNSTILE_API_HEADERS"`
+	APIFetchModes []string `yaml:"api_fetch_modes" env:"TURNSTILE_API_FETCH_MODES"`
+
+	// IPAllowlist, when set, admits only clients from these networks (IP
+	// addresses or CIDRs) and IPDenylist rejects clients from them.
+	// Clients from TrustedNetworks skip sign-in. TrustedProxies are the
+	// proxies whose X-Forwarded-For entries are believed when determining
+	// the client IP; AnyProxy trusts the immediate peer, whatever its
+	// address, to add one entry.
+	IPAllowlist     []string `yaml:"ip_allowlist" env:"TURNSTILE_IP_ALLOWLIST"`
+	IPDenylist      []string `yaml:"ip_denylist" env:"TURNSTILE_IP_DENYLIST"`
+	TrustedNetworks []string `yaml:"trusted_networks" env:"TURNSTILE_TRUSTED_NETWORKS"`
+	TrustedProxies  []string `yaml:"trusted_proxies" env:"TURNSTILE_TRUSTED_PROXIES"`
+
+	TLSCertFile      string `yaml:"tls_cert_file" env:"TURNSTILE_TLS_CERT_FILE"`
+	TLSKeyFile       string `yaml:"tls_key_file" env:"TURNSTILE_TLS_KEY_FILE"`
+	TLSMinVersion    string `yaml:"tls_min_version" env:"TURNSTILE_TLS_MIN_VERSION"`
+	TLSCipherPolicy  string `yaml:"tls_cipher_policy" env:"TURNSTILE_TLS_CIPHER_POLICY"`
+	HTTPRedirectPort int    `yaml:"http_redirect_port" env:"TURNSTILE_HTTP_REDIRECT_PORT"`
+
+	// Secret files: each secret above can instead be read from a file, e.g. a
+	// mounted volume, so it never appears in the process environment.
+	RailwayClientSecretFile string `yaml:"railway_client_secret_file" env:"RAILWAY_CLIENT_SECRET_FILE"`
+	RateLimitRedisURLFile   string `yaml:"rate_limit_redis_url_file" env:"TURNSTILE_RATE_LIMIT_REDIS_URL_FILE"`
+
+	// Routes customize how requests under specific paths are handled. They
+	// can only be set in the config file.
+	Routes []Route `yaml:"routes"`
+
+	// File is the config file this config was loaded from, if any.
+	File string `yaml:"-"`
+
+	// secretFiles lists the secret files that were read, so changes to them
+	// trigger a reload.
+	secretFiles []string
 }
 
-func Load() (*Config, error) {
-	portStr := os.Getenv("PORT")
-	if portStr == "" {
-		portStr = "8080"
-	}
+// Route overrides proxying for requests matching Path, which uses the same
+// pattern syntax as http.ServeMux: a trailing slash matches the whole subtree.
+type Route struct {
+	Path string `yaml:"path"`
 
-	authPrefix := os.Getenv("TURNSTILE_AUTH_PREFIX")
-	if authPrefix == "" {
-		authPrefix = "/_turnstile"
-	}
+	// BackendURLs sends matching requests to different upstreams. Defaults
+	// to the top-level backend_urls.
+	BackendURLs []string `yaml:"backend_urls"`
 
-	logLevel := os.Getenv("TURNSTILE_LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = "info"
-	}
+	// Public skips authentication for matching requests.
+	Public bool `yaml:"public"`
 
-	maxRetriesStr := os.Getenv("TURNSTILE_PROXY_MAX_RETRIES")
-	if maxRetriesStr == "" {
-		maxRetriesStr = "3"
-	}
+	// StripPrefix and AddPrefix override the top-level path rewriting for
+	// matching requests, e.g. to serve a backend's root under /docs/.
+	StripPrefix string `yaml:"strip_prefix"`
+	AddPrefix   string `yaml:"add_prefix"`
 
-	retryDelayStr := os.Getenv("TURNSTILE_PROXY_RETRY_DELAY")
-	if retryDelayStr == "" {
-		retryDelayStr = "1s"
-	}
+	// MaxRequestBodySize, UpstreamTimeout and StreamingTimeout override the
+	// top-level limits when non-zero.
+	MaxRequestBodySize int           `yaml:"max_request_body_size"`
+	UpstreamTimeout    time.Duration `yaml:"upstream_timeout"`
+	StreamingTimeout   time.Duration `yaml:"streaming_timeout"`
 
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid PORT: %w", err)
+	// IPAllowlist, IPDenylist and TrustedNetworks replace the top-level
+	// lists when set.
+	IPAllowlist     []string `yaml:"ip_allowlist"`
+	IPDenylist      []string `yaml:"ip_denylist"`
+	TrustedNetworks []string `yaml:"trusted_networks"`
+
+	// RateLimit and RateLimitPeriod override the top-level per-user limit
+	// when non-zero. Each route has its own buckets.
+	RateLimit       int           `yaml:"rate_limit"`
+	RateLimitPeriod time.Duration `yaml:"rate_limit_period"`
+
+	// RequestHeaders and ResponseHeaders are applied after the top-level
+	// header rules.
+	RequestHeaders  HeaderRules `yaml:"request_headers"`
+	ResponseHeaders HeaderRules `yaml:"response_headers"`
+
+	// Upstream overrides the top-level upstream connection settings for
+	// BackendURLs.
+	Upstream UpstreamOverride `yaml:",inline"`
+}
+
+// Backend discovery modes.
+const (
+	DiscoveryStatic = "static"
+	DiscoveryDNS    = "dns"
+)
+
+// Load balancing strategies.
+const (
+	LBRoundRobin     = "round_robin"
+	LBLeastConn      = "least_conn"
+	LBConsistentHash = "consistent_hash"
+)
+
+// Content encodings supported for response compression.
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+)
+
+// TLS versions accepted for tls_min_version.
+const (
+	TLS12 = "1.2"
+	TLS13 = "1.3"
+)
+
+// TLS cipher policies. The default policy uses Go's default cipher suites;
+// the strict policy allows only forward-secret AEAD suites.
+const (
+	TLSPolicyDefault = "default"
+	TLSPolicyStrict  = "strict"
+)
+
+// AnyProxy in TrustedProxies trusts the immediate peer whatever its
+// address, e.g. Railway's edge, whose addresses aren't known in advance.
+const AnyProxy = "*"
+
+// maxAllowedRetries bounds TURNSTILE_PROXY_MAX_RETRIES.
+const maxAllowedRetries = 10
+
+// Default returns a Config with every optional setting at its default.
+func Default() *Config {
+	return &Config{
+		Port:            8080,
+		AuthPrefix:      "/_turnstile",
+		LogLevel:        "info",
+		ProxyMaxRetries: 3,
+		ProxyRetryDelay: 1 * time.Second,
+		ReadyPath:       "/",
+		ReadyCacheTTL:   5 * time.Second,
+
+		HealthCheckInterval:  10 * time.Second,
+		HealthCheckTimeout:   5 * time.Second,
+		HealthCheckThreshold: 2,
+
+		BackendDiscovery:         DiscoveryStatic,
+		BackendDiscoveryInterval: 30 * time.Second,
+		LBStrategy:               LBRoundRobin,
+		LBEjectThreshold:         3,
+		LBEjectDuration:          30 * time.Second,
+
+		BreakerSuccessThreshold: 1,
+		BreakerCooldown:         30 * time.Second,
+
+		Upstream: Upstream{
+			MaxIdleConns:    100,
+			IdleConnTimeout: 90 * time.Second,
+			DialTimeout:     30 * time.Second,
+		},
+
+		CompressionEncodings: []string{EncodingBrotli, EncodingZstd, EncodingGzip},
+		CompressionMinSize:   1024,
+		CompressionTypes: []string{
+			"text/*",
+			"application/javascript",
+			"application/json",
+			"application/ld+json",
+			"application/manifest+json",
+			"application/wasm",
+			"application/xml",
+			"image/svg+xml",
+		},
+
+		CacheMaxSize:       64 << 20,
+		CacheMaxObjectSize: 4 << 20,
+
+		AuthRateLimit:       30,
+		AuthRateLimitPeriod: time.Minute,
+		RateLimitPeriod:     time.Minute,
+
+		APIPaths:      []string{"/api/"},
+		APIHeaders:    []string{"X-Requested-With"},
+		APIFetchModes: []string{"cors", "same-origin", "websocket"},
+
+		DefaultLanguage: i18n.Source,
+
+		TLSMinVersion:   TLS12,
+		TLSCipherPolicy: TLSPolicyDefault,
 	}
+}
 
-	maxRetries, err := strconv.Atoi(maxRetriesStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid TURNSTILE_PROXY_MAX_RETRIES: %w", err)
+// Load builds the configuration from defaults, then the config file named by
+// TURNSTILE_CONFIG_FILE (if set), then environment variables, and validates
+// the result. Validation errors point at the file line or environment
+// variable the bad value came from.
+func Load() (*Config, error) {
+	cfg := Default()
+	src := &sources{env: make(map[string]string)}
+
+	if path := os.Getenv("TURNSTILE_CONFIG_FILE"); path != "" {
+		if err := loadFile(path, cfg, src); err != nil {
+			return nil, err
+		}
+		cfg.File = path
 	}
-	const maxAllowedRetries = 10
-	if maxRetries < 0 || maxRetries > maxAllowedRetries {
-		return nil, fmt.Errorf("TURNSTILE_PROXY_MAX_RETRIES must be between 0 and %d", maxAllowedRetries)
+
+	if err := applyEnv(cfg, src); err != nil {
+		return nil, err
 	}
 
-	retryDelay, err := time.ParseDuration(retryDelayStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid TURNSTILE_PROXY_RETRY_DELAY: %w", err)
+	if err := resolveSecrets(cfg, src); err != nil {
+		return nil, err
 	}
-	if retryDelay <= 0 {
-		return nil, fmt.Errorf("TURNSTILE_PROXY_RETRY_DELAY must be > 0")
+
+	// A trailing slash on the public URL is harmless; any other path isn't.
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+
+	// The active health check probes the readiness path unless told otherwise.
+	if cfg.HealthCheckPath == "" {
+		cfg.HealthCheckPath = cfg.ReadyPath
 	}
 
-	cfg := &Config{
-		RailwayClientID:     os.Getenv("RAILWAY_CLIENT_ID"),
-		RailwayClientSecret: os.Getenv("RAILWAY_CLIENT_SECRET"),
-		RailwayProjectID:    os.Getenv("RAILWAY_PROJECT_ID"),
-		BackendURL:          os.Getenv("TURNSTILE_BACKEND_URL"),
-		PublicURL:           os.Getenv("TURNSTILE_PUBLIC_URL"),
-		Port:                port,
-		AuthPrefix:          authPrefix,
-		LogLevel:            logLevel,
-		ProxyMaxRetries:     maxRetries,
-		ProxyRetryDelay:     retryDelay,
+	// Behind a proxy that isn't trusted every client shares the proxy's
+	// address, so a per-IP sign-in limit would be one bucket for everyone.
+	// Only apply the default limit when client IPs can be told apart.
+	if !src.isSet("auth_rate_limit") && len(cfg.TrustedProxies) == 0 && !cfg.TLSEnabled() {
+		cfg.AuthRateLimit = 0
 	}
 
 	if err := cfg.Validate(); err != nil {
-		return nil, err
+		return nil, src.annotate(err)
 	}
 
 	return cfg, nil
 }
 
+// FieldError is a validation error for a single setting, identified by its
+// config file key (e.g. "proxy_max_retries" or "routes.1.path").
+type FieldError struct {
+	Key     string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	if env := envNames[e.topKey()]; env != "" {
+		return env + " " + e.Message
+	}
+	return e.Key + " " + e.Message
+}
+
+// topKey returns the top-level setting the error belongs to, e.g.
+// "backend_urls" for "backend_urls.1".
+func (e *FieldError) topKey() string {
+	key, _, _ := strings.Cut(e.Key, ".")
+	return key
+}
+
+func fieldErr(key, format string, args ...any) error {
+	return &FieldError{Key: key, Message: fmt.Sprintf(format, args...)}
+}
+
+// Validate checks that required settings are present and every setting is
+// in range. All problems are reported, joined into a single error.
 func (c *Config) Validate() error {
+	var errs []error
+	add := func(err error) { errs = append(errs, err) }
+
 	if c.RailwayClientID == "" {
-		return fmt.Errorf("RAILWAY_CLIENT_ID is required")
+		add(fieldErr("railway_client_id", "is required"))
 	}
 	if c.RailwayClientSecret == "" {
-		return fmt.Errorf("RAILWAY_CLIENT_SECRET is required")
+		add(fieldErr("railway_client_secret", "is required"))
 	}
 	if c.RailwayProjectID == "" {
-		return fmt.Errorf("RAILWAY_PROJECT_ID is required")
+		add(fieldErr("railway_project_id", "is required"))
+	}
+	if len(c.BackendURLs) == 0 {
+		add(fieldErr("backend_urls", "is required"))
 	}
-	if c.BackendURL == "" {
-		return fmt.Errorf("TURNSTILE_BACKEND_URL is required")
+	for i, raw := range c.BackendURLs {
+		if err := validateBackendURL(raw); err != nil {
+			add(fieldErr(fmt.Sprintf("backend_urls.%d", i), "%v", err))
+		}
 	}
 	if c.PublicURL == "" {
-		return fmt.Errorf("TURNSTILE_PUBLIC_URL is required")
+		add(fieldErr("public_url", "is required"))
+	} else if err := validatePublicURL(c.PublicURL); err != nil {
+		add(fieldErr("public_url", "%v", err))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		add(fieldErr("port", "must be between 1 and 65535"))
+	}
+	if err := validatePathPrefix(c.AuthPrefix); err != nil {
+		add(fieldErr("auth_prefix", "%v", err))
+	}
+	switch strings.ToLower(strings.TrimSpace(c.LogLevel)) {
+	case "debug", "info", "warn", "error":
+	default:
+		add(fieldErr("log_level", "must be one of debug, info, warn, error"))
+	}
+
+	// The OAuth redirect URI is composed from the public URL and auth prefix
+	// and must match what's registered with Railway exactly, so check that
+	// the composition round-trips to the expected callback path.
+	if validatePublicURL(c.PublicURL) == nil && validatePathPrefix(c.AuthPrefix) == nil {
+		redirectURI := c.URI(RouteCallback, FullURL)
+		if u, err := url.Parse(redirectURI); err != nil || u.Path != c.URI(RouteCallback, PathOnly) {
+			add(fieldErr("public_url", "produces an invalid OAuth redirect URI %q", redirectURI))
+		}
+	}
+
+	if c.ProxyMaxRetries < 0 || c.ProxyMaxRetries > maxAllowedRetries {
+		add(fieldErr("proxy_max_retries", "must be between 0 and %d", maxAllowedRetries))
+	}
+	if c.ProxyRetryDelay <= 0 {
+		add(fieldErr("proxy_retry_delay", "must be > 0"))
+	}
+	for _, code := range c.ProxyRetryStatusCodes {
+		if code < 500 || code > 599 {
+			add(fieldErr("proxy_retry_status_codes", "must only contain 5xx status codes, got %d", code))
+		}
+	}
+	if c.ProxyRetryBudget < 0 {
+		add(fieldErr("proxy_retry_budget", "must be >= 0"))
+	}
+
+	if !strings.HasPrefix(c.ReadyPath, "/") {
+		add(fieldErr("ready_path", "must start with /"))
+	}
+	if c.ReadyExpectedStatus != 0 && (c.ReadyExpectedStatus < 100 || c.ReadyExpectedStatus > 599) {
+		add(fieldErr("ready_expected_status", "must be a valid HTTP status code"))
+	}
+	if c.ReadyCacheTTL < 0 {
+		add(fieldErr("ready_cache_ttl", "must be >= 0"))
+	}
+
+	if c.HealthCheckInterval < 0 {
+		add(fieldErr("health_check_interval", "must be >= 0"))
+	}
+	if !strings.HasPrefix(c.HealthCheckPath, "/") {
+		add(fieldErr("health_check_path", "must start with /"))
+	}
+	if c.HealthCheckTimeout <= 0 {
+		add(fieldErr("health_check_timeout", "must be > 0"))
+	}
+	if c.HealthCheckThreshold < 1 {
+		add(fieldErr("health_check_threshold", "must be >= 1"))
+	}
+
+	if c.BackendDiscovery != DiscoveryStatic && c.BackendDiscovery != DiscoveryDNS {
+		add(fieldErr("backend_discovery", "must be %q or %q", DiscoveryStatic, DiscoveryDNS))
+	}
+	if c.BackendDiscoveryInterval <= 0 {
+		add(fieldErr("backend_discovery_interval", "must be > 0"))
+	}
+	switch c.LBStrategy {
+	case LBRoundRobin, LBLeastConn, LBConsistentHash:
+	default:
+		add(fieldErr("lb_strategy", "must be one of %q, %q, %q", LBRoundRobin, LBLeastConn, LBConsistentHash))
+	}
+	if c.LBEjectThreshold < 0 {
+		add(fieldErr("lb_eject_threshold", "must be >= 0"))
+	}
+	if c.LBEjectDuration <= 0 {
+		add(fieldErr("lb_eject_duration", "must be > 0"))
+	}
+
+	if c.BreakerFailureThreshold < 0 {
+		add(fieldErr("breaker_failure_threshold", "must be >= 0"))
+	}
+	if c.BreakerSuccessThreshold < 1 {
+		add(fieldErr("breaker_success_threshold", "must be >= 1"))
+	}
+	if c.BreakerCooldown <= 0 {
+		add(fieldErr("breaker_cooldown", "must be > 0"))
+	}
+
+	errs = append(errs, c.Upstream.validate("")...)
+	errs = append(errs, validateRewrite("", c.StripPrefix, c.AddPrefix)...)
+	errs = append(errs, validateLimits("", c.MaxRequestBodySize, c.UpstreamTimeout, c.StreamingTimeout)...)
+
+	for i, enc := range c.CompressionEncodings {
+		switch enc {
+		case EncodingBrotli, EncodingZstd, EncodingGzip:
+		default:
+			add(fieldErr(fmt.Sprintf("compression_encodings.%d", i), "must be one of %q, %q, %q", EncodingBrotli, EncodingZstd, EncodingGzip))
+		}
+	}
+	if c.Compression && len(c.CompressionEncodings) == 0 {
+		add(fieldErr("compression_encodings", "must not be empty when compression is enabled"))
+	}
+	if c.CompressionMinSize < 0 {
+		add(fieldErr("compression_min_size", "must be >= 0"))
+	}
+	for i, typ := range c.CompressionTypes {
+		if !strings.Contains(typ, "/") {
+			add(fieldErr(fmt.Sprintf("compression_types.%d", i), "must be a media type like text/html or text/*, got %q", typ))
+		}
+	}
+
+	if c.CacheMaxSize < 1 {
+		add(fieldErr("cache_max_size", "must be >= 1"))
+	}
+	if c.CacheMaxObjectSize < 1 || c.CacheMaxObjectSize > c.CacheMaxSize {
+		add(fieldErr("cache_max_object_size", "must be between 1 and cache_max_size"))
+	}
+	if c.CacheDir != "" {
+		if info, err := os.Stat(c.CacheDir); err != nil || !info.IsDir() {
+			add(fieldErr("cache_dir", "must be an existing directory, got %q", c.CacheDir))
+		}
+	}
+
+	if c.AuthRateLimit < 0 {
+		add(fieldErr("auth_rate_limit", "must be >= 0"))
+	}
+	if c.AuthRateLimitPeriod <= 0 {
+		add(fieldErr("auth_rate_limit_period", "must be > 0"))
+	}
+	if c.RateLimit < 0 {
+		add(fieldErr("rate_limit", "must be >= 0"))
+	}
+	if c.RateLimitPeriod <= 0 {
+		add(fieldErr("rate_limit_period", "must be > 0"))
+	}
+	if c.RateLimitRedisURL != "" {
+		if u, err := url.Parse(c.RateLimitRedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			// Don't echo the value: it may contain a password.
+			add(fieldErr("rate_limit_redis_url", "must be a redis:// or rediss:// URL"))
+		}
+	}
+
+	if c.ThemeDir != "" {
+		if info, err := os.Stat(c.ThemeDir); err != nil || !info.IsDir() {
+			add(fieldErr("theme_dir", "must be an existing directory, got %q", c.ThemeDir))
+		}
+	}
+	if c.BrandLogoURL != "" && !strings.HasPrefix(c.BrandLogoURL, "/") && !isHTTPURL(c.BrandLogoURL) {
+		add(fieldErr("brand_logo_url", "must be a path starting with / or an http(s) URL, got %q", c.BrandLogoURL))
+	}
+	if c.BrandColor != "" && !brandColorPattern.MatchString(c.BrandColor) {
+		add(fieldErr("brand_color", "must be a hex color like #0a7cff, got %q", c.BrandColor))
+	}
+	if langs := i18n.Languages(); !slices.Contains(langs, c.DefaultLanguage) {
+		add(fieldErr("default_language", "must be one of %s, got %q", strings.Join(langs, ", "), c.DefaultLanguage))
+	}
+	if c.SupportContact != "" && c.SupportURL() == "" {
+		add(fieldErr("support_contact", "must be an email address or an http(s) URL, got %q", c.SupportContact))
+	}
+
+	for i, pattern := range c.APIPaths {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			add(fieldErr(fmt.Sprintf("api_paths.%d", i), "must be a path pattern starting with /, got %q", pattern))
+		}
+	}
+	for i, header := range c.APIHeaders {
+		name, _, _ := strings.Cut(header, ":")
+		if !validHeaderName(strings.TrimSpace(name)) {
+			add(fieldErr(fmt.Sprintf("api_headers.%d", i), "must be a header name, optionally followed by : and a value, got %q", header))
+		}
+	}
+	for i, mode := range c.APIFetchModes {
+		if mode != "cors" && mode != "no-cors" && mode != "same-origin" && mode != "websocket" {
+			add(fieldErr(fmt.Sprintf("api_fetch_modes.%d", i), "must be one of %q, %q, %q, %q, got %q", "cors", "no-cors", "same-origin", "websocket", mode))
+		}
+	}
+
+	errs = append(errs, validateNetworks("ip_allowlist", c.IPAllowlist)...)
+	errs = append(errs, validateNetworks("ip_denylist", c.IPDenylist)...)
+	errs = append(errs, validateNetworks("trusted_networks", c.TrustedNetworks)...)
+	if slices.Contains(c.TrustedProxies, AnyProxy) {
+		if len(c.TrustedProxies) > 1 {
+			add(fieldErr("trusted_proxies", "%q can't be combined with other entries", AnyProxy))
+		}
+	} else {
+		errs = append(errs, validateNetworks("trusted_proxies", c.TrustedProxies)...)
+	}
+	// Without trusted proxies every client behind Railway's edge shares the
+	// edge's address, so a trusted network containing it would let anyone
+	// skip sign-in.
+	needsProxies := !c.TLSEnabled() && len(c.TrustedProxies) == 0
+	if needsProxies && len(c.TrustedNetworks) > 0 {
+		add(fieldErr("trusted_networks", "requires trusted_proxies unless tls_cert_file and tls_key_file are set"))
+	}
+
+	errs = append(errs, c.RequestHeaders.validate("request_headers", true)...)
+	errs = append(errs, c.ResponseHeaders.validate("response_headers", false)...)
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		add(fieldErr("tls_cert_file", "and tls_key_file must be set together"))
+	}
+	if c.TLSMinVersion != TLS12 && c.TLSMinVersion != TLS13 {
+		add(fieldErr("tls_min_version", "must be %q or %q", TLS12, TLS13))
+	}
+	if c.TLSCipherPolicy != TLSPolicyDefault && c.TLSCipherPolicy != TLSPolicyStrict {
+		add(fieldErr("tls_cipher_policy", "must be %q or %q", TLSPolicyDefault, TLSPolicyStrict))
+	}
+	if c.HTTPRedirectPort != 0 {
+		switch {
+		case c.HTTPRedirectPort < 1 || c.HTTPRedirectPort > 65535:
+			add(fieldErr("http_redirect_port", "must be between 1 and 65535"))
+		case c.HTTPRedirectPort == c.Port:
+			add(fieldErr("http_redirect_port", "must differ from port"))
+		case !c.TLSEnabled():
+			add(fieldErr("http_redirect_port", "requires tls_cert_file and tls_key_file"))
+		case !strings.HasPrefix(c.PublicURL, "https://"):
+			add(fieldErr("http_redirect_port", "requires public_url to use https"))
+		}
+	}
+
+	seen := make(map[string]bool)
+	patterns := newRouteMux(c.AuthPrefix)
+	for i, route := range c.Routes {
+		key := fmt.Sprintf("routes.%d", i)
+		switch {
+		case !strings.HasPrefix(route.Path, "/"):
+			add(fieldErr(key+".path", "must start with /"))
+		case route.Path == "/" || strings.HasPrefix(route.Path, c.AuthPrefix+"/") || route.Path == c.AuthPrefix:
+			add(fieldErr(key+".path", "must not be / or under the auth prefix %s", c.AuthPrefix))
+		case seen[route.Path]:
+			add(fieldErr(key+".path", "duplicates an earlier route"))
+		default:
+			if err := patterns.add(route.Path); err != nil {
+				add(fieldErr(key+".path", "is not a usable pattern: %v", err))
+			}
+		}
+		seen[route.Path] = true
+
+		for j, raw := range route.BackendURLs {
+			if err := validateBackendURL(raw); err != nil {
+				add(fieldErr(fmt.Sprintf("%s.backend_urls.%d", key, j), "%v", err))
+			}
+		}
+		if route.Upstream != (UpstreamOverride{}) && len(route.BackendURLs) == 0 {
+			add(fieldErr(key, "upstream settings require backend_urls"))
+		}
+		errs = append(errs, Upstream{}.Merge(route.Upstream).validate(key+".")...)
+		errs = append(errs, validateRewrite(key+".", route.StripPrefix, route.AddPrefix)...)
+		errs = append(errs, validateLimits(key+".", route.MaxRequestBodySize, route.UpstreamTimeout, route.StreamingTimeout)...)
+		if route.RateLimit < 0 {
+			add(fieldErr(key+".rate_limit", "must be >= 0"))
+		}
+		if route.RateLimitPeriod < 0 {
+			add(fieldErr(key+".rate_limit_period", "must be >= 0"))
+		}
+		errs = append(errs, validateNetworks(key+".ip_allowlist", route.IPAllowlist)...)
+		errs = append(errs, validateNetworks(key+".ip_denylist", route.IPDenylist)...)
+		errs = append(errs, validateNetworks(key+".trusted_networks", route.TrustedNetworks)...)
+		if needsProxies && len(route.TrustedNetworks) > 0 {
+			add(fieldErr(key+".trusted_networks", "requires trusted_proxies unless tls_cert_file and tls_key_file are set"))
+		}
+		errs = append(errs, route.RequestHeaders.validate(key+".request_headers", true)...)
+		errs = append(errs, route.ResponseHeaders.validate(key+".response_headers", false)...)
+		if route.StripPrefix != "" && route.Path != route.StripPrefix && !strings.HasPrefix(route.Path, route.StripPrefix+"/") {
+			add(fieldErr(key+".strip_prefix", "must be a prefix of the route path %s", route.Path))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateBackendURL checks that raw is an absolute http(s) URL with a host
+// and nothing but an optional path.
+func validateBackendURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("is not a valid URL: %q", raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must start with http:// or https://, got %q", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("must include a host, got %q", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("must not include credentials, a query or a fragment, got %q", raw)
 	}
 	return nil
 }
+
+// validatePublicURL checks that raw is the bare origin Turnstile is served
+// from, e.g. https://auth.example.com.
+func validatePublicURL(raw string) error {
+	if err := validateBackendURL(raw); err != nil {
+		return err
+	}
+	if u, _ := url.Parse(raw); u.Path != "" {
+		return fmt.Errorf("must not include a path, got %q", raw)
+	}
+	return nil
+}
+
+// validateRewrite checks the optional strip and add path prefixes, with keys
+// prefixed by prefix (e.g. "routes.0.").
+func validateRewrite(prefix, strip, add string) []error {
+	var errs []error
+	if strip != "" {
+		if err := validatePathPrefix(strip); err != nil {
+			errs = append(errs, fieldErr(prefix+"strip_prefix", "%v", err))
+		}
+	}
+	if add != "" {
+		if err := validatePathPrefix(add); err != nil {
+			errs = append(errs, fieldErr(prefix+"add_prefix", "%v", err))
+		}
+	}
+	return errs
+}
+
+// validateLimits checks the body size limit and timeouts, with keys
+// prefixed by prefix (e.g. "routes.0.").
+func validateLimits(prefix string, maxBody int, timeout, streamingTimeout time.Duration) []error {
+	var errs []error
+	if maxBody < 0 {
+		errs = append(errs, fieldErr(prefix+"max_request_body_size", "must be >= 0"))
+	}
+	if timeout < 0 {
+		errs = append(errs, fieldErr(prefix+"upstream_timeout", "must be >= 0"))
+	}
+	if streamingTimeout < 0 {
+		errs = append(errs, fieldErr(prefix+"streaming_timeout", "must be >= 0"))
+	}
+	return errs
+}
+
+// validatePathPrefix checks that prefix is a plain path like /_turnstile.
+func validatePathPrefix(prefix string) error {
+	if !strings.HasPrefix(prefix, "/") || prefix == "/" || strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("must start with / and not end with /, got %q", prefix)
+	}
+	if strings.Contains(prefix, "//") || strings.ContainsAny(prefix, "?#{}* \t") {
+		return fmt.Errorf("must be a plain path without empty segments or special characters, got %q", prefix)
+	}
+	return nil
+}
+
+// DisplayName returns the protected app's name for Turnstile's pages.
+func (c *Config) DisplayName() string {
+	if c.AppName != "" {
+		return c.AppName
+	}
+	if u, err := url.Parse(c.PublicURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "this application"
+}
+
+// brandColorPattern matches #rgb and #rrggbb colors.
+var brandColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// SupportURL returns the link for SupportContact: a mailto: URL for an email
+// address, the URL itself for an http(s) URL, or "" if it is neither.
+func (c *Config) SupportURL() string {
+	switch {
+	case isHTTPURL(c.SupportContact):
+		return c.SupportContact
+	case strings.Contains(c.SupportContact, "@") && !strings.ContainsAny(c.SupportContact, " :/"):
+		return (&url.URL{Scheme: "mailto", Opaque: c.SupportContact}).String()
+	}
+	return ""
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// TrustsAnyProxy reports whether the immediate peer is trusted to add the
+// client's address to X-Forwarded-For, whatever its own address.
+func (c *Config) TrustsAnyProxy() bool {
+	return slices.Contains(c.TrustedProxies, AnyProxy)
+}
+
+// UntrustedIPSettings returns the keys of settings that act on client IPs
+// when those IPs can't be resolved: with no trusted proxies and TLS off,
+// every client behind a proxy has the proxy's address.
+func (c *Config) UntrustedIPSettings() []string {
+	if len(c.TrustedProxies) > 0 || c.TLSEnabled() {
+		return nil
+	}
+	var keys []string
+	if len(c.IPAllowlist) > 0 {
+		keys = append(keys, "ip_allowlist")
+	}
+	if len(c.IPDenylist) > 0 {
+		keys = append(keys, "ip_denylist")
+	}
+	for i, route := range c.Routes {
+		if len(route.IPAllowlist) > 0 {
+			keys = append(keys, fmt.Sprintf("routes.%d.ip_allowlist", i))
+		}
+		if len(route.IPDenylist) > 0 {
+			keys = append(keys, fmt.Sprintf("routes.%d.ip_denylist", i))
+		}
+	}
+	if c.AuthRateLimit > 0 {
+		keys = append(keys, "auth_rate_limit")
+	}
+	return keys
+}
+
+// TLSEnabled reports whether Turnstile terminates TLS itself.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// WatchPaths returns the files whose changes should trigger a reload: the
+// config file, any secret files and the TLS certificate and key.
+func (c *Config) WatchPaths() []string {
+	var paths []string
+	if c.File != "" {
+		paths = append(paths, c.File)
+	}
+	paths = append(paths, c.secretFiles...)
+	if c.TLSEnabled() {
+		paths = append(paths, c.TLSCertFile, c.TLSKeyFile)
+	}
+	return paths
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envNames maps config file keys to the environment variables that override
+// them, derived from the struct tags on Config.
+var envNames = func() map[string]string {
+	names := make(map[string]string)
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Config]()) {
+		if env := field.Tag.Get("env"); env != "" {
+			names[yamlKey(field)] = env
+		}
+	}
+	return names
+}()
+
+func yamlKey(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return key
+}
+
+// applyEnv overrides cfg with every non-empty environment variable named by
+// an env struct tag, including those of embedded structs, recording which
+// keys were set in src.
+func applyEnv(cfg *Config, src *sources) error {
+	v := reflect.ValueOf(cfg).Elem()
+
+	for _, field := range reflect.VisibleFields(v.Type()) {
+		env := field.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+
+		raw := os.Getenv(env)
+		if raw == "" {
+			continue
+		}
+
+		if err := setFromString(v.FieldByIndex(field.Index), raw); err != nil {
+			return fmt.Errorf("invalid %s: %w", env, err)
+		}
+		src.env[yamlKey(field)] = env
+	}
+
+	return nil
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// setFromString parses raw according to the type of dst. Lists are
+// comma-separated.
+func setFromString(dst reflect.Value, raw string) error {
+	switch {
+	case dst.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		dst.SetInt(int64(d))
+	case dst.Kind() == reflect.String:
+		dst.SetString(raw)
+	case dst.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		dst.SetInt(int64(n))
+	case dst.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		dst.SetBool(b)
+	case dst.Kind() == reflect.Slice:
+		items := splitList(raw)
+		list := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setFromString(list.Index(i), item); err != nil {
+				return fmt.Errorf("%q: %w", item, err)
+			}
+		}
+		dst.Set(list)
+	default:
+		return errors.New("unsupported setting type " + dst.Type().String())
+	}
+	return nil
+}
+
+// splitList splits a comma-separated value, trimming whitespace and dropping
+// empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
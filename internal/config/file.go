@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sources records where each setting came from so validation errors can
+// point at the right place.
+type sources struct {
+	file  string
+	lines map[string]int    // config file key -> line number
+	env   map[string]string // config file key -> environment variable
+}
+
+// loadFile decodes the YAML config file at path into cfg. Unknown keys and
+// type mismatches are rejected, with errors reported per line.
+func loadFile(path string, cfg *Config, src *sources) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	default:
+		return fmt.Errorf("config file %s: unsupported format, expected .yaml or .yml", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			errs := make([]error, len(typeErr.Errors))
+			for i, msg := range typeErr.Errors {
+				errs[i] = fmt.Errorf("%s:%s", path, strings.TrimPrefix(msg, "line "))
+			}
+			return errors.Join(errs...)
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	src.file = path
+	src.lines = make(map[string]int)
+	recordLines(&root, "", src.lines)
+	return nil
+}
+
+// recordLines walks a YAML node tree and records the line of every mapping
+// key and sequence item under its dotted path, e.g. "routes.0.path".
+func recordLines(node *yaml.Node, prefix string, lines map[string]int) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			recordLines(child, prefix, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := join(node.Content[i].Value)
+			lines[key] = node.Content[i].Line
+			recordLines(node.Content[i+1], key, lines)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			key := join(strconv.Itoa(i))
+			lines[key] = child.Line
+			recordLines(child, key, lines)
+		}
+	}
+}
+
+// isSet reports whether key was given in the config file or environment.
+func (s *sources) isSet(key string) bool {
+	_, inFile := s.lines[key]
+	_, inEnv := s.env[key]
+	return inFile || inEnv
+}
+
+// annotate rewrites validation errors to name the source of the bad value:
+// the environment variable if one was set, otherwise the config file line.
+func (s *sources) annotate(err error) error {
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+
+	out := make([]error, len(errs))
+	for i, e := range errs {
+		out[i] = e
+
+		var fieldErr *FieldError
+		if !errors.As(e, &fieldErr) {
+			continue
+		}
+		if _, fromEnv := s.env[fieldErr.topKey()]; fromEnv {
+			continue
+		}
+		if line, ok := s.lookupLine(fieldErr.Key); ok {
+			out[i] = fmt.Errorf("%s:%d: %s %s", s.file, line, fieldErr.Key, fieldErr.Message)
+		}
+	}
+	return errors.Join(out...)
+}
+
+// lookupLine finds the line for key, falling back to its closest parent
+// (e.g. the route item when the route has no path key at all).
+func (s *sources) lookupLine(key string) (int, bool) {
+	for key != "" {
+		if line, ok := s.lines[key]; ok {
+			return line, true
+		}
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return 0, false
+}
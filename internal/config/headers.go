@@ -0,0 +1,56 @@
+package config
+
+import (
+	"maps"
+	"slices"
+	"strings"
+)
+
+// HeaderRules modify the headers of a request or response: Remove is applied
+// first, then Set replaces any existing values, then Add appends.
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+	Remove []string          `yaml:"remove"`
+}
+
+// validate reports invalid header names and values under key. Host can't be
+// changed by request rules, since the proxy sets it per upstream instance.
+func (r HeaderRules) validate(key string, request bool) []error {
+	var errs []error
+	check := func(name string) {
+		switch {
+		case !validHeaderName(name):
+			errs = append(errs, fieldErr(key, "has an invalid header name %q", name))
+		case request && strings.EqualFold(name, "Host"):
+			errs = append(errs, fieldErr(key, "must not change the Host header"))
+		}
+	}
+
+	for _, name := range r.Remove {
+		check(name)
+	}
+	for _, rules := range []map[string]string{r.Set, r.Add} {
+		for _, name := range slices.Sorted(maps.Keys(rules)) {
+			check(name)
+			if strings.ContainsAny(rules[name], "\r\n") {
+				errs = append(errs, fieldErr(key, "header %s must not contain line breaks", name))
+			}
+		}
+	}
+	return errs
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name (an
+// RFC 9110 token).
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= 0x7f || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ParseNetwork parses a CIDR like 10.0.0.0/8, or a single IP address as a
+// network of one.
+func ParseNetwork(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("must be an IP address or CIDR, got %q", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("must be an IP address or CIDR, got %q", s)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// Networks parses a validated list of networks.
+func Networks(values []string) []netip.Prefix {
+	var networks []netip.Prefix
+	for _, v := range values {
+		if p, err := ParseNetwork(v); err == nil {
+			networks = append(networks, p)
+		}
+	}
+	return networks
+}
+
+func validateNetworks(key string, values []string) []error {
+	var errs []error
+	for i, v := range values {
+		if _, err := ParseNetwork(v); err != nil {
+			errs = append(errs, fieldErr(fmt.Sprintf("%s.%d", key, i), "%v", err))
+		}
+	}
+	return errs
+}
@@ -1,12 +1,25 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
 type RouteKey string
 
 const (
+	RouteSignIn   RouteKey = "signin"
 	RouteLogin    RouteKey = "login"
 	RouteLogout   RouteKey = "logout"
+	RouteMe       RouteKey = "me"
+	RouteSession  RouteKey = "session"
+	RouteRefresh  RouteKey = "refresh"
 	RouteCallback RouteKey = "callback"
 	RouteHealth   RouteKey = "health"
+	RouteReady    RouteKey = "ready"
 	RouteCatchAll RouteKey = "*"
 )
 
@@ -18,10 +31,15 @@ const (
 )
 
 var routePaths = map[RouteKey]string{
+	RouteSignIn:   "/signin",
 	RouteLogin:    "/oauth/login",
 	RouteLogout:   "/oauth/logout",
+	RouteMe:       "/me",
+	RouteSession:  "/session",
+	RouteRefresh:  "/oauth/refresh",
 	RouteCallback: "/oauth/callback",
 	RouteHealth:   "/health",
+	RouteReady:    "/ready",
 	RouteCatchAll: "/{catchAll...}",
 }
 
@@ -32,3 +50,36 @@ func (c *Config) URI(key RouteKey, urlType URLType) string {
 	}
 	return path
 }
+
+// routeMux mirrors the ServeMux built from the config, so that route paths it
+// would panic on (invalid patterns, or ones conflicting with an earlier route
+// or Turnstile's own paths) are reported as config errors instead.
+type routeMux struct {
+	mux *http.ServeMux
+}
+
+func newRouteMux(authPrefix string) *routeMux {
+	m := &routeMux{mux: http.NewServeMux()}
+	m.add("/")
+	m.add(authPrefix + "/static/")
+	for _, path := range routePaths {
+		m.add(authPrefix + path)
+	}
+	return m
+}
+
+// registeredAt matches the source locations ServeMux adds to its conflict
+// messages, which mean nothing to someone editing the config.
+var registeredAt = regexp.MustCompile(` \(registered at [^)]*\)`)
+
+// add registers pattern, returning ServeMux's objection to it, if any.
+func (m *routeMux) add(pattern string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			msg, _, _ := strings.Cut(fmt.Sprint(p), "\n")
+			err = errors.New(strings.TrimSuffix(registeredAt.ReplaceAllString(msg, ""), ":"))
+		}
+	}()
+	m.mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
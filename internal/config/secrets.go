@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// secretFields lists the Config fields tagged secret:"true". Each must have a
+// companion <Name>File field holding the path of a file to read it from.
+var secretFields = func() []string {
+	var names []string
+	t := reflect.TypeFor[Config]()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+		if _, ok := t.FieldByName(field.Name + "File"); !ok {
+			panic("config: secret field " + field.Name + " has no " + field.Name + "File companion")
+		}
+		names = append(names, field.Name)
+	}
+	return names
+}()
+
+// resolveSecrets reads secrets whose _file variant is set. An environment
+// variable beats the config file, as everywhere else; setting both the
+// secret and its file at the same level is an error.
+func resolveSecrets(cfg *Config, src *sources) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	for _, name := range secretFields {
+		field, _ := t.FieldByName(name)
+		fileField, _ := t.FieldByName(name + "File")
+		key, fileKey := yamlKey(field), yamlKey(fileField)
+
+		_, valueFromEnv := src.env[key]
+		_, fileFromEnv := src.env[fileKey]
+		_, valueInFile := src.lines[key]
+		_, fileInFile := src.lines[fileKey]
+
+		switch {
+		case valueFromEnv && fileFromEnv:
+			return fmt.Errorf("set only one of %s and %s", envNames[key], envNames[fileKey])
+		case valueFromEnv:
+			continue
+		case !fileFromEnv && valueInFile && fileInFile:
+			return fmt.Errorf("%s: set only one of %s and %s", src.file, key, fileKey)
+		}
+
+		path := v.FieldByName(name + "File").String()
+		if path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", fileKey, err)
+		}
+		v.FieldByName(name).SetString(strings.TrimSpace(string(data)))
+		cfg.secretFiles = append(cfg.secretFiles, path)
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the config with secrets masked, for display.
+func (c *Config) Redacted() *Config {
+	out := *c
+	v := reflect.ValueOf(&out).Elem()
+	for _, name := range secretFields {
+		if field := v.FieldByName(name); field.String() != "" {
+			field.SetString(redacted)
+		}
+	}
+	return &out
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"reflect"
+	"time"
+)
+
+// Upstream configures the connection to the backend. The top-level settings
+// apply to every backend; a route with its own backend_urls can override any
+// of them.
+type Upstream struct {
+	// CAFile is a PEM bundle of CAs trusted for the backend's certificate,
+	// in addition to the system roots.
+	CAFile string `yaml:"upstream_ca_file" env:"TURNSTILE_UPSTREAM_CA_FILE"`
+
+	// CertFile and KeyFile are a client certificate presented to the
+	// backend (mTLS).
+	CertFile string `yaml:"upstream_cert_file" env:"TURNSTILE_UPSTREAM_CERT_FILE"`
+	KeyFile  string `yaml:"upstream_key_file" env:"TURNSTILE_UPSTREAM_KEY_FILE"`
+
+	// ServerName overrides the name sent in SNI and checked against the
+	// backend's certificate.
+	ServerName string `yaml:"upstream_server_name" env:"TURNSTILE_UPSTREAM_SERVER_NAME"`
+
+	// InsecureSkipVerify disables certificate verification. For development
+	// only.
+	InsecureSkipVerify bool `yaml:"upstream_insecure_skip_verify" env:"TURNSTILE_UPSTREAM_INSECURE_SKIP_VERIFY"`
+
+	MaxIdleConns          int           `yaml:"upstream_max_idle_conns" env:"TURNSTILE_UPSTREAM_MAX_IDLE_CONNS"`
+	IdleConnTimeout       time.Duration `yaml:"upstream_idle_conn_timeout" env:"TURNSTILE_UPSTREAM_IDLE_CONN_TIMEOUT"`
+	DialTimeout           time.Duration `yaml:"upstream_dial_timeout" env:"TURNSTILE_UPSTREAM_DIAL_TIMEOUT"`
+	ResponseHeaderTimeout time.Duration `yaml:"upstream_response_header_timeout" env:"TURNSTILE_UPSTREAM_RESPONSE_HEADER_TIMEOUT"`
+}
+
+// UpstreamOverride holds a route's upstream settings. Every setting present
+// in the config file replaces the top-level one, even when false, empty or
+// 0, so a route can turn certificate verification back on or clear a timeout.
+type UpstreamOverride struct {
+	CAFile                *string        `yaml:"upstream_ca_file"`
+	CertFile              *string        `yaml:"upstream_cert_file"`
+	KeyFile               *string        `yaml:"upstream_key_file"`
+	ServerName            *string        `yaml:"upstream_server_name"`
+	InsecureSkipVerify    *bool          `yaml:"upstream_insecure_skip_verify"`
+	MaxIdleConns          *int           `yaml:"upstream_max_idle_conns"`
+	IdleConnTimeout       *time.Duration `yaml:"upstream_idle_conn_timeout"`
+	DialTimeout           *time.Duration `yaml:"upstream_dial_timeout"`
+	ResponseHeaderTimeout *time.Duration `yaml:"upstream_response_header_timeout"`
+}
+
+// Merge returns u with every setting present in override applied.
+func (u Upstream) Merge(override UpstreamOverride) Upstream {
+	out := reflect.ValueOf(&u).Elem()
+	in := reflect.ValueOf(override)
+	for i := range in.NumField() {
+		if field := in.Field(i); !field.IsNil() {
+			out.FieldByName(in.Type().Field(i).Name).Set(field.Elem())
+		}
+	}
+	return u
+}
+
+// validate reports problems with the upstream settings, with keys prefixed
+// by prefix (e.g. "routes.0.").
+func (u Upstream) validate(prefix string) []error {
+	var errs []error
+	if (u.CertFile == "") != (u.KeyFile == "") {
+		errs = append(errs, fieldErr(prefix+"upstream_cert_file", "and upstream_key_file must be set together"))
+	}
+	if u.MaxIdleConns < 0 {
+		errs = append(errs, fieldErr(prefix+"upstream_max_idle_conns", "must be >= 0"))
+	}
+	if u.IdleConnTimeout < 0 {
+		errs = append(errs, fieldErr(prefix+"upstream_idle_conn_timeout", "must be >= 0"))
+	}
+	if u.DialTimeout < 0 {
+		errs = append(errs, fieldErr(prefix+"upstream_dial_timeout", "must be >= 0"))
+	}
+	if u.ResponseHeaderTimeout < 0 {
+		errs = append(errs, fieldErr(prefix+"upstream_response_header_timeout", "must be >= 0"))
+	}
+	return errs
+}
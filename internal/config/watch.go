@@ -0,0 +1,77 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often watched files are checked for changes.
+const watchInterval = 2 * time.Second
+
+// Watch calls reload whenever the process receives SIGHUP or one of the files
+// returned by paths changes (by modification time or size). paths is called
+// again after every reload, so the watched set can follow the config. Watch
+// blocks until ctx is done.
+func Watch(ctx context.Context, paths func() []string, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	stamps := statAll(paths())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("config reload requested", "reason", "SIGHUP")
+		case <-ticker.C:
+			current := statAll(paths())
+			if equalStamps(stamps, current) {
+				continue
+			}
+			slog.Info("config reload requested", "reason", "file changed")
+		}
+
+		reload()
+		stamps = statAll(paths())
+	}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	missing bool
+}
+
+func statAll(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			stamps[path] = fileStamp{missing: true}
+			continue
+		}
+		stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps
+}
+
+func equalStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, stamp := range a {
+		other, ok := b[path]
+		if !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size || other.missing != stamp.missing {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+// Package csrf protects Turnstile's own state-changing endpoints from
+// cross-site requests.
+package csrf
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"turnstile/internal/problem"
+	"turnstile/internal/session"
+	"turnstile/internal/views"
+)
+
+const (
+	// FieldName is the form field carrying the token.
+	FieldName = "csrf_token"
+	// HeaderName is the request header carrying the token, for scripts.
+	HeaderName = "X-CSRF-Token"
+)
+
+// Protector rejects unsafe requests that come from another site or lack the
+// session's CSRF token.
+type Protector struct {
+	sessions *session.Manager
+	origin   string // e.g. "https://app.example.com"
+	problems *problem.Writer
+}
+
+// New returns a Protector for a deployment served at publicURL.
+func New(sessions *session.Manager, publicURL string, renderer *views.Renderer) *Protector {
+	origin := publicURL
+	if u, err := url.Parse(publicURL); err == nil {
+		origin = u.Scheme + "://" + u.Host
+	}
+	return &Protector{sessions: sessions, origin: origin, problems: problem.NewWriter(renderer)}
+}
+
+// Protect checks unsafe requests to next: browsers' Sec-Fetch-Site and
+// Origin headers must not name another site, and the request must carry
+// the session's token in the form field or header. Safe methods pass
+// through; they must not change state.
+func (p *Protector) Protect(next http.Handler) http.Handler {
+	return p.protect(next, true)
+}
+
+// ProtectSession is Protect for endpoints that only act on the caller's own
+// session, such as signing out. Without a session a forged request has
+// nothing to act on, so it only has to pass the site checks; this lets a
+// user whose session already expired still sign out.
+func (p *Protector) ProtectSession(next http.Handler) http.Handler {
+	return p.protect(next, false)
+}
+
+func (p *Protector) protect(next http.Handler, requireSession bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if reason := p.check(r, requireSession); reason != "" {
+			slog.Warn("csrf check failed", "path", r.URL.Path, "reason", reason)
+			p.serveForbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check returns why r fails the CSRF checks, or "" if it passes.
+func (p *Protector) check(r *http.Request, requireSession bool) string {
+	// "none" is a user-initiated navigation, e.g. a bookmark.
+	switch site := r.Header.Get("Sec-Fetch-Site"); site {
+	case "", "same-origin", "none":
+	default:
+		return "sec-fetch-site " + site
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && origin != p.origin {
+		return "origin " + origin
+	}
+
+	sess, err := p.sessions.GetSession(r)
+	if err != nil || sess == nil {
+		if !requireSession {
+			return ""
+		}
+		return "no session"
+	}
+	token := r.Header.Get(HeaderName)
+	if token == "" {
+		token = r.PostFormValue(FieldName)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRFToken)) != 1 {
+		return "token mismatch"
+	}
+	return ""
+}
+
+func (p *Protector) serveForbidden(w http.ResponseWriter, r *http.Request) {
+	p.problems.Write(w, r, problem.Details{
+		Status:  http.StatusForbidden,
+		Code:    "csrf_failed",
+		Detail:  "csrf.unverified",
+		Message: "csrf.unverified_message",
+		Buttons: []views.ErrorPageButton{{Label: "button.go_back", URL: "/"}},
+	})
+}
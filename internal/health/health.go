@@ -0,0 +1,170 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// CheckFunc probes a single dependency and returns nil if it is usable.
+type CheckFunc func(ctx context.Context) error
+
+// StatusFunc reports the current state of an in-process component (e.g. a
+// circuit breaker) without probing anything. A non-nil error marks the
+// component unavailable.
+type StatusFunc func() (state string, err error)
+
+// Result is the outcome of a single dependency check. The report is public,
+// so why a check failed is only logged: errors can name internal hosts.
+type Result struct {
+	Status    string `json:"status"`
+	State     string `json:"state,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// Report is the aggregated readiness report served as JSON.
+type Report struct {
+	Status    string            `json:"status"`
+	CheckedAt time.Time         `json:"checked_at"`
+	Checks    map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name   string
+	fn     CheckFunc
+	status StatusFunc
+}
+
+// Checker runs a set of dependency checks and caches the resulting report
+// for ttl, so frequent readiness polling doesn't hammer the dependencies.
+type Checker struct {
+	ttl     time.Duration
+	timeout time.Duration
+	checks  []namedCheck
+
+	mu     sync.Mutex
+	report *Report
+}
+
+func NewChecker(ttl, timeout time.Duration) *Checker {
+	return &Checker{ttl: ttl, timeout: timeout}
+}
+
+// Add registers a named check. It must be called before the checker serves
+// any requests.
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.checks = append(c.checks, namedCheck{name: name, fn: fn})
+}
+
+// AddStatus registers a named component state that is included in every
+// report. It must be called before the checker serves any requests.
+func (c *Checker) AddStatus(name string, fn StatusFunc) {
+	c.checks = append(c.checks, namedCheck{name: name, status: fn})
+}
+
+// Report returns the cached report, or runs every check concurrently if the
+// cache has expired. Concurrent callers wait for a single run.
+func (c *Checker) Report(ctx context.Context) *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.report != nil && time.Since(c.report.CheckedAt) < c.ttl {
+		return c.report
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.timeout)
+	defer cancel()
+
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		if check.status != nil {
+			state, err := check.status()
+			results[i] = Result{Status: StatusOK, State: state}
+			if err != nil {
+				results[i].Status = StatusUnavailable
+				slog.Warn("readiness check failed", "check", check.name, "error", err)
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := check.fn(ctx)
+			results[i] = Result{Status: StatusOK, LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				results[i].Status = StatusUnavailable
+				slog.Warn("readiness check failed", "check", check.name, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Status: StatusOK, CheckedAt: time.Now(), Checks: make(map[string]Result, len(c.checks))}
+	for i, check := range c.checks {
+		report.Checks[check.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+
+	c.report = report
+	return report
+}
+
+// ServeHTTP writes the readiness report, responding 503 if any check failed.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := c.Report(r.Context())
+
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// HTTPCheck returns a CheckFunc that sends a GET request to url. If
+// expectedStatus is 0, any response below 500 counts as healthy; otherwise
+// the response status must match exactly.
+func HTTPCheck(client *http.Client, url string, expectedStatus int) CheckFunc {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("create request: %w", err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+		if expectedStatus == 0 {
+			if resp.StatusCode >= http.StatusInternalServerError {
+				return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+			}
+			return nil
+		}
+		if resp.StatusCode != expectedStatus {
+			return fmt.Errorf("unexpected status: %d (want %d)", resp.StatusCode, expectedStatus)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package httpx
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Accept is a parsed Accept header.
+type Accept []mediaRange
+
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// Match specificities returned by Accept.Quality.
+const (
+	MatchNone     = -1
+	MatchAny      = 0 // */*
+	MatchType     = 1 // e.g. text/*
+	MatchExplicit = 2 // e.g. text/html
+)
+
+// ParseAccept parses every Accept header of r. Malformed ranges are skipped.
+func ParseAccept(r *http.Request) Accept {
+	var accept Accept
+	for _, value := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+			typ, subtype, _ := strings.Cut(mediaType, "/")
+			accept = append(accept, mediaRange{typ, subtype, q})
+		}
+	}
+	return accept
+}
+
+// Quality returns the quality the client gives mediaType, taken from the
+// most specific matching range, and how specific that range was.
+func (a Accept) Quality(mediaType string) (q float64, specificity int) {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	specificity = MatchNone
+	for _, rng := range a {
+		s := MatchNone
+		switch {
+		case rng.typ == typ && rng.subtype == subtype:
+			s = MatchExplicit
+		case rng.typ == typ && rng.subtype == "*":
+			s = MatchType
+		case rng.typ == "*" && rng.subtype == "*":
+			s = MatchAny
+		}
+		if s > specificity {
+			q, specificity = rng.q, s
+		}
+	}
+	return q, specificity
+}
+
+// PrefersJSON reports whether the client names a JSON type (application/json
+// or any +json type) and ranks it above HTML. Browsers accept JSON only
+// through */*, so their navigations never prefer it.
+func (a Accept) PrefersJSON() bool {
+	jsonQ := 0.0
+	for _, rng := range a {
+		if rng.typ == "application" && (rng.subtype == "json" || strings.HasSuffix(rng.subtype, "+json")) {
+			jsonQ = max(jsonQ, rng.q)
+		}
+	}
+	if jsonQ == 0 {
+		return false
+	}
+	htmlQ, specificity := a.Quality("text/html")
+	return jsonQ > htmlQ || (jsonQ == htmlQ && specificity < MatchType)
+}
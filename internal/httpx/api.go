@@ -0,0 +1,107 @@
+package httpx
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type apiRequestKey struct{}
+
+// APIDetector decides whether a request comes from a script or API client
+// (as opposed to a browser navigation), so callers can respond with a 401
+// or JSON instead of redirects or HTML pages.
+type APIDetector struct {
+	paths      []string
+	headers    []headerMatch
+	fetchModes []string
+}
+
+type headerMatch struct {
+	name, value string // an empty value matches any
+}
+
+// NewAPIDetector returns a detector that treats requests as API requests
+// when their path matches one of paths (a trailing slash matches the whole
+// subtree, otherwise path.Match patterns), they carry one of headers ("Name"
+// or "Name: value"), their Sec-Fetch-Mode is one of fetchModes, or their
+// Accept or Content-Type header prefers JSON.
+func NewAPIDetector(paths, headers, fetchModes []string) *APIDetector {
+	d := &APIDetector{paths: paths, fetchModes: fetchModes}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		d.headers = append(d.headers, headerMatch{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+	return d
+}
+
+// defaultAPIDetector is used outside of APIDetector.Middleware.
+var defaultAPIDetector = NewAPIDetector([]string{"/api/"}, []string{"X-Requested-With"}, []string{"cors", "same-origin", "websocket"})
+
+// Middleware classifies each request once, for IsAPIRequest.
+func (d *APIDetector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), apiRequestKey{}, d.Detect(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Detect reports whether r is an API request. Top-level browser navigations
+// (Sec-Fetch-Mode: navigate) never are, whatever their path.
+func (d *APIDetector) Detect(r *http.Request) bool {
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		if mode == "navigate" {
+			return false
+		}
+		for _, m := range d.fetchModes {
+			if strings.EqualFold(mode, m) {
+				return true
+			}
+		}
+	}
+
+	for _, h := range d.headers {
+		if v := r.Header.Get(h.name); v != "" && (h.value == "" || strings.EqualFold(v, h.value)) {
+			return true
+		}
+	}
+
+	for _, pattern := range d.paths {
+		if matchPath(pattern, r.URL.Path) {
+			return true
+		}
+	}
+
+	if ParseAccept(r).PrefersJSON() {
+		return true
+	}
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	contentType = strings.TrimSpace(contentType)
+	return contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
+
+// matchPath matches p against pattern, where a trailing slash matches the
+// whole subtree and anything else uses path.Match.
+func matchPath(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if strings.HasPrefix(p, pattern) {
+			return true
+		}
+		pattern += "*"
+		for strings.Count(p, "/") > strings.Count(pattern, "/") {
+			p = p[:strings.LastIndex(p, "/")]
+		}
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// IsAPIRequest reports whether r is an API request, as classified by
+// APIDetector.Middleware or, outside of it, the default detector.
+func IsAPIRequest(r *http.Request) bool {
+	if api, ok := r.Context().Value(apiRequestKey{}).(bool); ok {
+		return api
+	}
+	return defaultAPIDetector.Detect(r)
+}
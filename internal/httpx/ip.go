@@ -0,0 +1,100 @@
+package httpx
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// IPResolver determines the client IP of each request from the connection
+// and the X-Forwarded-For entries added by trusted proxies.
+type IPResolver struct {
+	trusted []netip.Prefix
+	// trustPeer trusts the immediate peer whatever its address, for
+	// deployments behind a single proxy (Railway's edge) whose addresses
+	// aren't known in advance.
+	trustPeer bool
+}
+
+// NewIPResolver returns a resolver that believes X-Forwarded-For entries
+// added by proxies in trusted. If trusted is empty and trustPeer is set, the
+// immediate peer is trusted to add one entry. With neither, the header is
+// ignored and the connection's address is used.
+func NewIPResolver(trusted []netip.Prefix, trustPeer bool) *IPResolver {
+	return &IPResolver{trusted: trusted, trustPeer: trustPeer && len(trusted) == 0}
+}
+
+// Middleware resolves the client IP once per request, for ClientIP.
+func (res *IPResolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{}, res.resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// resolve walks X-Forwarded-For from the right, starting at the peer, and
+// returns the first address not added by a trusted proxy. Entries further
+// left are client-supplied and can't be believed.
+func (res *IPResolver) resolve(r *http.Request) netip.Addr {
+	client := peerAddr(r)
+	if !res.trustPeer && !res.isTrusted(client) {
+		return client
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Garbage from a client; the last good hop is all we know.
+			break
+		}
+		client = addr.Unmap()
+		if res.trustPeer || !res.isTrusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+func (res *IPResolver) isTrusted(addr netip.Addr) bool {
+	for _, p := range res.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the client's IP address as resolved by
+// IPResolver.Middleware, or the connection's peer address outside of it.
+func ClientAddr(r *http.Request) netip.Addr {
+	if addr, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return addr
+	}
+	return peerAddr(r)
+}
+
+// ClientIP returns ClientAddr as a string.
+func ClientIP(r *http.Request) string {
+	addr := ClientAddr(r)
+	if !addr.IsValid() {
+		return r.RemoteAddr
+	}
+	return addr.String()
+}
+
+func peerAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
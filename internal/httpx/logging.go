@@ -30,6 +30,7 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		start := time.Now()
 
 		slog.Info("request_incoming",
+			"request_id", GetRequestID(r.Context()),
 			"method", r.Method,
 			"path", r.URL.Path,
 			"query", r.URL.RawQuery,
@@ -40,6 +41,7 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(rw, r)
 
 		slog.Info("request",
+			"request_id", GetRequestID(r.Context()),
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", rw.statusCode,
@@ -59,3 +61,9 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer, so the
+// reverse proxy can flush streamed responses (SSE) through this wrapper.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
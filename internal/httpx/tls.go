@@ -0,0 +1,68 @@
+package httpx
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+
+	"turnstile/internal/config"
+)
+
+// CertLoader serves a certificate loaded from disk and can swap in a new one
+// without restarting the listener, e.g. after a certificate renewal.
+type CertLoader struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// NewCertLoader loads the certificate and key from the given PEM files.
+func NewCertLoader(certFile, keyFile string) (*CertLoader, error) {
+	l := &CertLoader{}
+	if err := l.Reload(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload replaces the served certificate. On error the current certificate
+// stays in use.
+func (l *CertLoader) Reload(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+	l.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (l *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.cert.Load(), nil
+}
+
+// strictCipherSuites are the forward-secret AEAD suites allowed by the strict
+// cipher policy. TLS 1.3 suites are not configurable and are always AEAD.
+var strictCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// ServerTLSConfig returns the listener's TLS configuration for cfg, serving
+// certificates from certs and offering HTTP/2.
+func ServerTLSConfig(cfg *config.Config, certs *CertLoader) *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if cfg.TLSMinVersion == config.TLS13 {
+		tlsConfig.MinVersion = tls.VersionTLS13
+	}
+	if cfg.TLSCipherPolicy == config.TLSPolicyStrict {
+		tlsConfig.CipherSuites = strictCipherSuites
+	}
+	return tlsConfig
+}
@@ -0,0 +1,165 @@
+// Package i18n holds the message catalogs for Turnstile's pages and error
+// responses, and picks one for each request from its Accept-Language header.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//go:embed locales/*.json
+var localeFS embed.FS
+
+// Source is the language messages are written in. Every other catalog falls
+// back to it for messages it lacks.
+const Source = "en"
+
+// Languages returns the languages with a catalog, sorted.
+func Languages() []string {
+	files, _ := fs.Glob(localeFS, "locales/*.json")
+	var langs []string
+	for _, f := range files {
+		langs = append(langs, strings.TrimSuffix(path.Base(f), ".json"))
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+// Catalog maps message IDs to the text of one language. Messages are
+// fmt format strings; translations can reorder arguments with %[n]s.
+type Catalog struct {
+	Lang     string
+	messages map[string]string
+	fallback *Catalog
+}
+
+// T returns the message with args formatted into it. A missing message is
+// taken from the source catalog, or rendered as its ID.
+func (c *Catalog) T(id string, args ...any) string {
+	msg, ok := c.lookup(id)
+	if !ok {
+		return id
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Has reports whether id is a known message.
+func (c *Catalog) Has(id string) bool {
+	_, ok := c.lookup(id)
+	return ok
+}
+
+func (c *Catalog) lookup(id string) (string, bool) {
+	for cat := c; cat != nil; cat = cat.fallback {
+		if msg, ok := cat.messages[id]; ok {
+			return msg, true
+		}
+	}
+	return "", false
+}
+
+// Bundle is the set of catalogs, with the one to use when the client's
+// preferences can't be met.
+type Bundle struct {
+	catalogs map[string]*Catalog
+	def      *Catalog
+}
+
+// NewBundle loads the embedded catalogs. Translations may only contain
+// messages the source catalog has, so a typo in an ID can't go unnoticed.
+func NewBundle(defaultLang string) (*Bundle, error) {
+	b := &Bundle{catalogs: make(map[string]*Catalog)}
+	for _, lang := range Languages() {
+		data, err := localeFS.ReadFile("locales/" + lang + ".json")
+		if err != nil {
+			return nil, err
+		}
+		cat := &Catalog{Lang: lang}
+		if err := json.Unmarshal(data, &cat.messages); err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", lang, err)
+		}
+		b.catalogs[lang] = cat
+	}
+
+	source := b.catalogs[Source]
+	if source == nil {
+		return nil, fmt.Errorf("missing %s catalog", Source)
+	}
+	for lang, cat := range b.catalogs {
+		if cat == source {
+			continue
+		}
+		cat.fallback = source
+		for id := range cat.messages {
+			if _, ok := source.messages[id]; !ok {
+				return nil, fmt.Errorf("catalog %s: unknown message %q", lang, id)
+			}
+		}
+	}
+
+	b.def = b.catalogs[defaultLang]
+	if b.def == nil {
+		return nil, fmt.Errorf("no catalog for default language %q", defaultLang)
+	}
+	return b, nil
+}
+
+// Catalogs returns every catalog, keyed by language.
+func (b *Bundle) Catalogs() map[string]*Catalog {
+	return b.catalogs
+}
+
+// Match returns the catalog for the most preferred language in an
+// Accept-Language header, trying "de" for "de-AT", or the default catalog.
+func (b *Bundle) Match(acceptLanguage string) *Catalog {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && q > 0 {
+			prefs = append(prefs, pref{tag, q})
+		}
+	}
+	slices.SortStableFunc(prefs, func(a, b pref) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+
+	for _, p := range prefs {
+		if p.tag == "*" {
+			break
+		}
+		if cat, ok := b.catalogs[p.tag]; ok {
+			return cat
+		}
+		if base, _, ok := strings.Cut(p.tag, "-"); ok {
+			if cat, ok := b.catalogs[base]; ok {
+				return cat
+			}
+		}
+	}
+	return b.def
+}
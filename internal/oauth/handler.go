@@ -1,6 +1,8 @@
 package oauth
 
 import (
+	"cmp"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -12,8 +14,12 @@ import (
 	"strings"
 	"time"
 
+	"turnstile/internal/auth"
 	"turnstile/internal/config"
+	"turnstile/internal/csrf"
+	"turnstile/internal/health"
 	"turnstile/internal/httpx"
+	"turnstile/internal/problem"
 	"turnstile/internal/railway"
 	"turnstile/internal/session"
 	"turnstile/internal/views"
@@ -23,6 +29,9 @@ const (
 	oauthAuthURL       = "https://backboard.railway.com/oauth/auth"
 	oauthTokenURL      = "https://backboard.railway.com/oauth/token"
 	redirectCookieName = "oauth_redirect"
+
+	// silentStatePrefix marks the OAuth state of silent re-authentication.
+	silentStatePrefix = "silent."
 )
 
 type Handler struct {
@@ -30,6 +39,7 @@ type Handler struct {
 	session  *session.Manager
 	railway  *railway.Client
 	renderer *views.Renderer
+	problems *problem.Writer
 }
 
 type tokenResponse struct {
@@ -46,7 +56,32 @@ func NewHandler(cfg *config.Config, sessionManager *session.Manager, railwayClie
 		session:  sessionManager,
 		railway:  railwayClient,
 		renderer: renderer,
+		problems: problem.NewWriter(renderer),
+	}
+}
+
+// SignInHandler shows the sign-in landing page, whose button starts the
+// OAuth flow with the intended destination. Signed-in users are sent
+// straight there.
+func (h *Handler) SignInHandler(w http.ResponseWriter, r *http.Request) {
+	redirectTo := r.URL.Query().Get("redirect")
+	if !isSafeRedirect(redirectTo) {
+		redirectTo = "/"
+	}
+
+	if sess, _ := h.session.GetSession(r); sess != nil {
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	loginURL := h.cfg.URI(config.RouteLogin, config.PathOnly)
+	if redirectTo != "/" {
+		loginURL += "?redirect=" + url.QueryEscape(redirectTo)
 	}
+	h.renderer.RenderSignInPage(w, r, views.SignInPageData{
+		AppName:  h.cfg.DisplayName(),
+		LoginURL: loginURL,
+	})
 }
 
 func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -57,11 +92,40 @@ func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	prompt := ""
+	if r.URL.Query().Get("reconsent") == "true" {
+		prompt = "consent"
+	}
+	h.startAuth(w, r, prompt, false)
+}
+
+// RefreshHandler starts a silent re-authentication, run by turnstile.js in a
+// hidden iframe or popup. Railway is asked not to show any pages
+// (prompt=none) unless interactive=true, and the callback reports the result
+// to the opening window instead of redirecting.
+func (h *Handler) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	prompt := "none"
+	if r.URL.Query().Get("interactive") == "true" {
+		prompt = ""
+	}
+	h.startAuth(w, r, prompt, true)
+}
+
+// startAuth redirects to Railway's authorization endpoint. Silent flows are
+// marked in the state, so the callback knows how to respond.
+func (h *Handler) startAuth(w http.ResponseWriter, r *http.Request, prompt string, silent bool) {
 	state, err := generateState()
 	if err != nil {
-		http.Error(w, "Failed to generate state", http.StatusInternalServerError)
+		h.problems.Write(w, r, problem.Details{
+			Status: http.StatusInternalServerError,
+			Code:   "state_failed",
+			Detail: "oauth.state_failed",
+		})
 		return
 	}
+	if silent {
+		state = silentStatePrefix + state
+	}
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     "oauth_state",
@@ -74,7 +138,7 @@ func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	// Persist the post-login redirect destination in a cookie
-	if redirectTo := r.URL.Query().Get("redirect"); isSafeRedirect(redirectTo) {
+	if redirectTo := r.URL.Query().Get("redirect"); !silent && isSafeRedirect(redirectTo) {
 		http.SetCookie(w, &http.Cookie{
 			Name:     redirectCookieName,
 			Value:    redirectTo,
@@ -97,8 +161,8 @@ func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		"state":         {state},
 	}
 
-	if r.URL.Query().Get("reconsent") == "true" {
-		params.Set("prompt", "consent")
+	if prompt != "" {
+		params.Set("prompt", prompt)
 	}
 
 	authURL := oauthAuthURL + "?" + params.Encode()
@@ -110,14 +174,28 @@ func (h *Handler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	loginURL := h.cfg.URI(config.RouteLogin, config.PathOnly)
 
+	// Silent re-authentication runs out of sight, so its result is posted
+	// back to the page that started it rather than shown. The state is only
+	// trusted once it matches the cookie, but an unverified claim of silence
+	// only changes where an error is reported.
+	silent := strings.HasPrefix(r.URL.Query().Get("state"), silentStatePrefix)
+	fail := func(d problem.Details) {
+		if silent {
+			h.renderSilentResult(w, r, nil, d.Code)
+			return
+		}
+		h.problems.Write(w, r, d)
+	}
+
 	stateCookie, err := r.Cookie("oauth_state")
 	if err != nil {
 		slog.Error("oauth_callback_error", "error", "missing_state_cookie", "err", err)
-		h.renderer.RenderErrorPage(w, http.StatusBadRequest, views.ErrorPageData{
-			Title:    "Bad Request: 400",
-			Subtitle: "Something went wrong with the login request.",
-			Message:  "Missing state cookie.",
-			Buttons:  []views.ErrorPageButton{{Label: "Back to login", URL: loginURL}},
+		fail(problem.Details{
+			Status:  http.StatusBadRequest,
+			Code:    "missing_state",
+			Detail:  "oauth.login_request_failed",
+			Message: "oauth.missing_state",
+			Buttons: []views.ErrorPageButton{{Label: "button.back_to_login", URL: loginURL}},
 		})
 		return
 	}
@@ -125,11 +203,12 @@ func (h *Handler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	state := r.URL.Query().Get("state")
 	if state == "" || state != stateCookie.Value {
 		slog.Error("oauth_callback_error", "error", "invalid_state", "state", state, "cookie", stateCookie.Value)
-		h.renderer.RenderErrorPage(w, http.StatusBadRequest, views.ErrorPageData{
-			Title:    "Bad Request: 400",
-			Subtitle: "Something went wrong with the login request.",
-			Message:  "Invalid state parameter.",
-			Buttons:  []views.ErrorPageButton{{Label: "Back to login", URL: loginURL}},
+		fail(problem.Details{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_state",
+			Detail:  "oauth.login_request_failed",
+			Message: "oauth.invalid_state",
+			Buttons: []views.ErrorPageButton{{Label: "button.back_to_login", URL: loginURL}},
 		})
 		return
 	}
@@ -161,18 +240,24 @@ func (h *Handler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	code := r.URL.Query().Get("code")
 	if code == "" {
-		errorDesc := r.URL.Query().Get("error_description")
-		if errorDesc == "" {
-			errorDesc = r.URL.Query().Get("error")
+		// Railway's description of the error isn't translated; it is shown
+		// within a localized message.
+		message, args := "oauth.authorization_failed", []any(nil)
+		if desc := cmp.Or(r.URL.Query().Get("error_description"), r.URL.Query().Get("error")); desc != "" {
+			message, args = "oauth.provider_error", []any{desc}
 		}
-		if errorDesc == "" {
-			errorDesc = "Authorization failed."
+		if silent {
+			// e.g. login_required when Railway needs the user to interact.
+			h.renderSilentResult(w, r, nil, cmp.Or(r.URL.Query().Get("error"), "authorization_failed"))
+			return
 		}
-		h.renderer.RenderErrorPage(w, http.StatusBadRequest, views.ErrorPageData{
-			Title:    "Bad Request: 400",
-			Subtitle: "Something went wrong with the login request.",
-			Message:  errorDesc,
-			Buttons:  []views.ErrorPageButton{{Label: "Back to login", URL: loginURL}},
+		fail(problem.Details{
+			Status:  http.StatusBadRequest,
+			Code:    "authorization_failed",
+			Detail:  "oauth.login_request_failed",
+			Message: message,
+			Args:    args,
+			Buttons: []views.ErrorPageButton{{Label: "button.back_to_login", URL: loginURL}},
 		})
 		return
 	}
@@ -180,63 +265,277 @@ func (h *Handler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	tokens, err := h.exchangeCode(code)
 	if err != nil {
 		slog.Error("oauth_callback_error", "error", "token_exchange_failed", "err", err)
-		h.renderer.RenderErrorPage(w, http.StatusInternalServerError, views.ErrorPageData{
-			Title:    "Internal Server Error: 500",
-			Subtitle: "Something went wrong when signing you in.",
-			Message:  "Unable to complete sign-in. Please try again.",
-			Buttons:  []views.ErrorPageButton{{Label: "Try again", URL: loginURL + "?reconsent=true"}},
+		fail(problem.Details{
+			Status:  http.StatusInternalServerError,
+			Code:    "token_exchange_failed",
+			Detail:  "oauth.sign_in_failed",
+			Message: "oauth.token_exchange_failed",
+			Buttons: []views.ErrorPageButton{{Label: "button.try_again", URL: loginURL + "?reconsent=true"}},
 		})
 		return
 	}
 
 	userInfo, err := h.railway.FetchUserInfo(tokens.AccessToken)
 	if err != nil {
-		h.renderer.RenderErrorPage(w, http.StatusInternalServerError, views.ErrorPageData{
-			Title:    "Internal Server Error: 500",
-			Subtitle: "Something went wrong when signing you in.",
-			Message:  "Failed to fetch user info.",
-			Buttons:  []views.ErrorPageButton{{Label: "Try again", URL: loginURL + "?reconsent=true"}},
+		fail(problem.Details{
+			Status:  http.StatusInternalServerError,
+			Code:    "user_info_failed",
+			Detail:  "oauth.sign_in_failed",
+			Message: "oauth.user_info_failed",
+			Buttons: []views.ErrorPageButton{{Label: "button.try_again", URL: loginURL + "?reconsent=true"}},
 		})
 		return
 	}
 
 	hasAccess, err := h.railway.UserHasProjectAccess(tokens.AccessToken, h.cfg.RailwayProjectID)
 	if err != nil {
-		h.renderer.RenderErrorPage(w, http.StatusInternalServerError, views.ErrorPageData{
-			Title:    "Internal Server Error: 500",
-			Subtitle: "Something went wrong when signing you in.",
-			Message:  "Failed to check project access.",
-			Buttons:  []views.ErrorPageButton{{Label: "Try again", URL: loginURL + "?reconsent=true"}},
+		fail(problem.Details{
+			Status:  http.StatusInternalServerError,
+			Code:    "access_check_failed",
+			Detail:  "oauth.sign_in_failed",
+			Message: "oauth.access_check_failed",
+			Buttons: []views.ErrorPageButton{{Label: "button.try_again", URL: loginURL + "?reconsent=true"}},
 		})
 		return
 	}
 
 	if !hasAccess {
+		if silent {
+			h.renderSilentResult(w, r, nil, "no_access")
+			return
+		}
 		loginErrURL := h.cfg.URI(config.RouteLogin, config.PathOnly) + "?error=no_access"
 		http.Redirect(w, r, loginErrURL, http.StatusTemporaryRedirect)
 		return
 	}
 
-	sess := h.session.CreateSession(userInfo.Sub, userInfo.Email, userInfo.Name, tokens.AccessToken)
-	if err := h.session.SetSessionCookie(w, r, sess); err != nil {
-		h.renderer.RenderErrorPage(w, http.StatusInternalServerError, views.ErrorPageData{
-			Title:    "Internal Server Error: 500",
-			Subtitle: "Something went wrong when signing you in.",
-			Message:  "Failed to create session.",
-			Buttons:  []views.ErrorPageButton{{Label: "Try again", URL: loginURL + "?reconsent=true"}},
+	sess, err := h.session.CreateSession(userInfo.Sub, userInfo.Email, userInfo.Name, userInfo.Picture, tokens.AccessToken)
+	if err == nil {
+		sess.UserAgent = r.UserAgent()
+		sess.IP = httpx.ClientIP(r)
+		// The new session replaces any this browser already had.
+		h.session.DeleteSession(r)
+		err = h.session.SetSessionCookie(w, r, sess)
+	}
+	if err != nil {
+		fail(problem.Details{
+			Status:  http.StatusInternalServerError,
+			Code:    "session_failed",
+			Detail:  "oauth.sign_in_failed",
+			Message: "oauth.session_failed",
+			Buttons: []views.ErrorPageButton{{Label: "button.try_again", URL: loginURL + "?reconsent=true"}},
 		})
 		return
 	}
 
+	if silent {
+		h.renderSilentResult(w, r, sess, "")
+		return
+	}
 	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 }
 
+// renderSilentResult ends a silent re-authentication, reporting the new
+// session or the error code to the page that started it.
+func (h *Handler) renderSilentResult(w http.ResponseWriter, r *http.Request, sess *session.Session, errCode string) {
+	data := views.SilentAuthPageData{TargetOrigin: h.publicOrigin(), Error: errCode}
+	if sess != nil {
+		data.OK = true
+		data.ExpiresAt = sess.ExpiresAt
+	}
+	h.renderer.RenderSilentAuthPage(w, r, data)
+}
+
+// publicOrigin returns the scheme and host of the public URL.
+func (h *Handler) publicOrigin() string {
+	u, err := url.Parse(h.cfg.PublicURL)
+	if err != nil {
+		return h.cfg.PublicURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// LogoutHandler shows a confirmation page on GET and signs out on POST, so
+// a cross-site link or image can't sign the user out. POSTs must pass the
+// CSRF checks (see csrf.Protector); with everywhere=true they end all of the
+// user's sessions.
 func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	h.session.ClearSessionCookie(w, r)
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		sess, _ := h.session.GetSession(r)
+		if sess == nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		h.renderer.RenderLogoutPage(w, r, views.LogoutPageData{
+			Email:     sess.Email,
+			LogoutURL: h.cfg.URI(config.RouteLogout, config.PathOnly),
+			CSRFField: csrf.FieldName,
+			CSRFToken: sess.CSRFToken,
+		})
+	case http.MethodPost:
+		if r.PostFormValue("everywhere") == "true" {
+			if sess, _ := h.session.GetSession(r); sess != nil {
+				h.session.DeleteUserSessions(sess.UserID)
+				slog.Info("signed out everywhere", "user_id", sess.UserID)
+			}
+		}
+		h.session.ClearSessionCookie(w, r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		h.problems.Write(w, r, problem.Details{
+			Status: http.StatusMethodNotAllowed,
+			Code:   "method_not_allowed",
+			Detail: "oauth.logout_method",
+		})
+	}
+}
+
+// sessionStatus is the response of SessionHandler.
+type sessionStatus struct {
+	Authenticated bool         `json:"authenticated"`
+	User          *sessionUser `json:"user,omitempty"`
+	ExpiresAt     *time.Time   `json:"expires_at,omitempty"`
+	ExpiresIn     int          `json:"expires_in"` // seconds
+	LoginURL      string       `json:"login_url"`
+	RefreshURL    string       `json:"refresh_url"`
+}
+
+type sessionUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// SessionHandler reports whether the request has a session and how long it
+// has left, so single-page apps can re-authenticate before it expires. It
+// answers 200 either way and never extends the session.
+func (h *Handler) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	status := sessionStatus{
+		LoginURL:   h.cfg.URI(config.RouteLogin, config.PathOnly),
+		RefreshURL: h.cfg.URI(config.RouteRefresh, config.PathOnly),
+	}
+	if sess, _ := h.session.GetSession(r); sess != nil {
+		status.Authenticated = true
+		status.User = &sessionUser{ID: sess.UserID, Email: sess.Email, Name: sess.Name}
+		status.ExpiresAt = &sess.ExpiresAt
+		status.ExpiresIn = max(int(time.Until(sess.ExpiresAt).Seconds()), 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+// meResponse is the JSON form of the account page.
+type meResponse struct {
+	User struct {
+		ID      string `json:"id"`
+		Email   string `json:"email"`
+		Name    string `json:"name"`
+		Picture string `json:"picture,omitempty"`
+	} `json:"user"`
+	Session  sessionJSON   `json:"session"`
+	Sessions []sessionJSON `json:"sessions"`
+}
+
+type sessionJSON struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Current   bool      `json:"current"`
+}
+
+// MeHandler shows the signed-in user's account page, or its JSON form for
+// API requests: who they are, this session, and their sessions on other
+// devices. It must be wrapped in auth.Middleware.RequireAuth.
+func (h *Handler) MeHandler(w http.ResponseWriter, r *http.Request) {
+	sess := auth.GetSessionFromContext(r.Context())
+	sessions := h.session.UserSessions(sess.UserID)
+
+	if httpx.IsAPIRequest(r) || r.URL.Query().Get("format") == "json" {
+		var resp meResponse
+		resp.User.ID = sess.UserID
+		resp.User.Email = sess.Email
+		resp.User.Name = sess.Name
+		resp.User.Picture = sess.Picture
+		resp.Sessions = []sessionJSON{}
+		for _, s := range sessions {
+			item := sessionJSON{
+				ID:        s.ID,
+				CreatedAt: s.CreatedAt,
+				ExpiresAt: s.ExpiresAt,
+				UserAgent: s.UserAgent,
+				IP:        s.IP,
+				Current:   s.ID == sess.ID,
+			}
+			if item.Current {
+				resp.Session = item
+			}
+			resp.Sessions = append(resp.Sessions, item)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	data := views.MePageData{
+		Name:      sess.Name,
+		Email:     sess.Email,
+		Picture:   sess.Picture,
+		CreatedAt: sess.CreatedAt,
+		ExpiresAt: sess.ExpiresAt,
+		LogoutURL: h.cfg.URI(config.RouteLogout, config.PathOnly),
+		CSRFField: csrf.FieldName,
+		CSRFToken: sess.CSRFToken,
+	}
+	for _, s := range sessions {
+		data.Sessions = append(data.Sessions, views.SessionItem{
+			Device:    describeDevice(s.UserAgent),
+			IP:        s.IP,
+			CreatedAt: s.CreatedAt,
+			Current:   s.ID == sess.ID,
+		})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.renderer.RenderMePage(w, r, data)
 }
 
-// handleAuthError renders a human-readable HTML error page. It is used when
+// describeDevice summarizes a User-Agent as "Browser on OS", or "" if it
+// isn't recognized.
+func describeDevice(userAgent string) string {
+	find := func(candidates [][2]string) string {
+		for _, c := range candidates {
+			if strings.Contains(userAgent, c[0]) {
+				return c[1]
+			}
+		}
+		return ""
+	}
+	// Order matters: most user agents also name the browsers and systems
+	// they claim compatibility with.
+	browser := find([][2]string{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	})
+	system := find([][2]string{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"CrOS", "ChromeOS"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	})
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	default:
+		return system
+	}
+}
+
+// handleAuthError responds with a human-readable error. It is used when
 // the login route is reached with an ?error= query parameter, indicating that
 // a previous OAuth attempt completed but was rejected (e.g. wrong project).
 func (h *Handler) handleAuthError(w http.ResponseWriter, r *http.Request, errType string) {
@@ -245,23 +544,37 @@ func (h *Handler) handleAuthError(w http.ResponseWriter, r *http.Request, errTyp
 
 	switch errType {
 	case "no_access":
-		h.renderer.RenderErrorPage(w, http.StatusForbidden, views.ErrorPageData{
-			Title:    "Forbidden: 403",
-			Subtitle: "You don't have permission to view this application.",
-			Note:     "Make sure you authorized Turnstile against the correct Railway project.",
-			Buttons:  []views.ErrorPageButton{{Label: "Reauthenticate & change permissions", URL: reconsentUrl}},
+		h.problems.Write(w, r, problem.Details{
+			Status:  http.StatusForbidden,
+			Code:    "no_access",
+			Detail:  "oauth.no_access",
+			Note:    "oauth.no_access_note",
+			Buttons: []views.ErrorPageButton{{Label: "button.reauthenticate", URL: reconsentUrl}},
 		})
 		return
 	default:
-		h.renderer.RenderErrorPage(w, http.StatusInternalServerError, views.ErrorPageData{
-			Title:    "Internal Server Error: 500",
-			Subtitle: "Something went wrong when signing you in.",
-			Message:  "An unknown error occurred during authentication. Try again below. If the issue persists, consult the Turnstile logs or submit an issue.",
-			Buttons:  []views.ErrorPageButton{{Label: "Try again", URL: reconsentUrl}},
+		h.problems.Write(w, r, problem.Details{
+			Status:  http.StatusInternalServerError,
+			Code:    "auth_error",
+			Detail:  "oauth.sign_in_failed",
+			Message: "oauth.unknown_error",
+			Buttons: []views.ErrorPageButton{{Label: "button.try_again", URL: reconsentUrl}},
 		})
 	}
 }
 
+// Ping checks that Railway's OAuth endpoints are reachable. Both endpoints
+// reject bare requests, so any response below 500 counts as reachable.
+func (h *Handler) Ping(ctx context.Context) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, endpoint := range []string{oauthAuthURL, oauthTokenURL} {
+		if err := health.HTTPCheck(client, endpoint, 0)(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (h *Handler) exchangeCode(code string) (*tokenResponse, error) {
 	data := url.Values{
 		"grant_type":   {"authorization_code"},
@@ -302,8 +615,17 @@ func (h *Handler) exchangeCode(code string) (*tokenResponse, error) {
 }
 
 // isSafeRedirect returns true only for relative paths, preventing open redirects.
+// Browsers treat \ like / and drop tabs and newlines, so /\evil.example
+// would leave the site; such values are rejected outright.
 func isSafeRedirect(redirectURL string) bool {
-	return strings.HasPrefix(redirectURL, "/") && !strings.HasPrefix(redirectURL, "//")
+	if !strings.HasPrefix(redirectURL, "/") || strings.HasPrefix(redirectURL, "//") {
+		return false
+	}
+	if strings.ContainsFunc(redirectURL, func(r rune) bool { return r == '\\' || r < 0x20 || r == 0x7f }) {
+		return false
+	}
+	u, err := url.Parse(redirectURL)
+	return err == nil && u.Scheme == "" && u.Host == ""
 }
 
 func generateState() (string, error) {
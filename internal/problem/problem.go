@@ -0,0 +1,183 @@
+// Package problem writes error responses in the format the client asks for:
+// Turnstile's error page for browsers, RFC 7807 problem details for API
+// clients, or plain text.
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"turnstile/internal/httpx"
+	"turnstile/internal/views"
+)
+
+// Details describes an error response. Title, Detail, Message, Note and
+// button labels are message IDs (see package i18n), translated into the
+// client's language when written.
+type Details struct {
+	Status int
+	Code   string // machine-readable, e.g. "rate_limited"
+	Title  string // page heading; defaults to e.g. "Bad Gateway: 502"
+	Detail string // one-line explanation
+	// Message, Note and Buttons add to the error page. Message is also
+	// appended to the detail in other formats, and is formatted with Args.
+	Message string
+	Args    []any
+	Note    string
+	Buttons []views.ErrorPageButton
+	// LoginURL tells API clients where to send the user to sign in.
+	LoginURL string
+}
+
+// Format is a representation of an error response.
+type Format int
+
+const (
+	HTML Format = iota
+	ProblemJSON
+	JSON
+	Text
+)
+
+// offers lists the formats in order of preference on ties.
+var offers = []struct {
+	format    Format
+	mediaType string
+}{
+	{HTML, "text/html"},
+	{ProblemJSON, "application/problem+json"},
+	{JSON, "application/json"},
+	{Text, "text/plain"},
+}
+
+// Negotiate picks the error format for r from its Accept header. When the
+// header names none of the formats (or is missing or */*), API requests get
+// problem details and everything else the HTML page.
+func Negotiate(r *http.Request) Format {
+	accept := httpx.ParseAccept(r)
+	best, bestQ, explicit := HTML, 0.0, false
+	for _, offer := range offers {
+		q, specificity := accept.Quality(offer.mediaType)
+		// A format the client names beats one it only accepts via */*.
+		if q > bestQ || (q == bestQ && q > 0 && specificity > httpx.MatchAny && !explicit) {
+			best, bestQ, explicit = offer.format, q, specificity > httpx.MatchAny
+		}
+	}
+
+	if !explicit {
+		if httpx.IsAPIRequest(r) {
+			return ProblemJSON
+		}
+		return HTML
+	}
+	return best
+}
+
+// Writer writes error responses.
+type Writer struct {
+	renderer *views.Renderer
+}
+
+func NewWriter(renderer *views.Renderer) *Writer {
+	return &Writer{renderer: renderer}
+}
+
+// Write sends the error in the negotiated format, tagged with the request
+// ID so it can be found in the logs.
+func (pw *Writer) Write(w http.ResponseWriter, r *http.Request, d Details) {
+	requestID := httpx.GetRequestID(r.Context())
+	cat := pw.renderer.Catalog(r)
+	text := func(id string, args ...any) string {
+		if id == "" {
+			return ""
+		}
+		return cat.T(id, args...)
+	}
+	message := text(d.Message, d.Args...)
+	detail := strings.TrimSpace(text(d.Detail) + " " + message)
+
+	switch format := Negotiate(r); format {
+	case HTML:
+		title := text(d.Title)
+		if title == "" {
+			status := http.StatusText(d.Status)
+			if id := "status." + strconv.Itoa(d.Status); cat.Has(id) {
+				status = cat.T(id)
+			}
+			title = cat.T("error.title", status, d.Status)
+		}
+		var buttons []views.ErrorPageButton
+		for _, b := range d.Buttons {
+			buttons = append(buttons, views.ErrorPageButton{Label: text(b.Label), URL: b.URL})
+		}
+		pw.renderer.RenderErrorPage(w, r, d.Status, views.ErrorPageData{
+			Title:     title,
+			Subtitle:  text(d.Detail),
+			Message:   message,
+			Note:      text(d.Note),
+			Buttons:   buttons,
+			RequestID: requestID,
+		})
+
+	case ProblemJSON, JSON:
+		contentType := "application/problem+json"
+		if format == JSON {
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Language", cat.Lang)
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(d.Status)
+		err := json.NewEncoder(w).Encode(problemBody{
+			Type:      "about:blank",
+			Title:     http.StatusText(d.Status),
+			Status:    d.Status,
+			Detail:    detail,
+			Instance:  r.URL.Path,
+			RequestID: requestID,
+			Error:     d.Code,
+			Message:   detail,
+			LoginURL:  d.LoginURL,
+		})
+		if err != nil {
+			slog.Debug("failed to write error response", "error", err)
+		}
+
+	case Text:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Language", cat.Lang)
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(d.Status)
+		fmt.Fprintf(w, "%d %s\n", d.Status, http.StatusText(d.Status))
+		if detail != "" {
+			fmt.Fprintln(w, detail)
+		}
+		if d.LoginURL != "" {
+			fmt.Fprintln(w, cat.T("error.sign_in", d.LoginURL))
+		}
+		if requestID != "" {
+			fmt.Fprintln(w, cat.T("error.request_id", requestID))
+		}
+	}
+}
+
+// problemBody is an RFC 7807 problem details object. Error and Message
+// repeat the code and detail under the names Turnstile's JSON errors have
+// always used.
+type problemBody struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Message   string `json:"message,omitempty"`
+	LoginURL  string `json:"login_url,omitempty"`
+}
@@ -0,0 +1,467 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"turnstile/internal/auth"
+	"turnstile/internal/config"
+	"turnstile/internal/httpx"
+)
+
+// errNoInstances is returned when there is no upstream instance to send a
+// request to, e.g. because DNS discovery hasn't resolved any addresses yet.
+var errNoInstances = errors.New("no upstream instances available")
+
+// instance is a single upstream address requests can be balanced across.
+type instance struct {
+	target    *url.URL        // scheme and host:port to dial
+	host      string          // Host header to send upstream
+	transport *http.Transport // see pool.transports
+
+	active atomic.Int64 // in-flight requests, for least-connections
+
+	mu            sync.Mutex
+	up            bool // result of active health checking
+	probeFailures int
+	failures      int // consecutive passive failures
+	ejectedUntil  time.Time
+}
+
+func newInstance(target *url.URL, host string, transport *http.Transport) *instance {
+	return &instance{target: target, host: host, transport: transport, up: true}
+}
+
+// RoundTrip sends req to the instance, with the backend's Host header.
+func (i *instance) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := new(http.Request)
+	*out = *req
+	u := *req.URL
+	u.Scheme = i.target.Scheme
+	u.Host = i.target.Host
+	out.URL = &u
+	out.Host = i.host
+	return i.transport.RoundTrip(out)
+}
+
+// available reports whether the instance is up and not passively ejected.
+func (i *instance) available(now time.Time) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.up && !now.Before(i.ejectedUntil)
+}
+
+func (i *instance) isUp() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.up
+}
+
+// pool holds the upstream instances and picks one per request attempt.
+type pool struct {
+	targets []*url.URL
+	// transports maps each target's host to the transport for its
+	// instances. Under DNS discovery requests are addressed to the resolved
+	// IP, so https targets get a clone of the upstream transport that still
+	// sends and verifies the backend's hostname.
+	transports        map[string]*http.Transport
+	strategy          string
+	discovery         bool
+	discoveryInterval time.Duration
+	ejectThreshold    int
+	ejectDuration     time.Duration
+
+	instances atomic.Pointer[[]*instance]
+	next      atomic.Uint64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newPool(cfg *config.Config, upstream *http.Transport) (*pool, error) {
+	p := &pool{
+		transports:        make(map[string]*http.Transport),
+		strategy:          cfg.LBStrategy,
+		discovery:         cfg.BackendDiscovery == config.DiscoveryDNS,
+		discoveryInterval: cfg.BackendDiscoveryInterval,
+		ejectThreshold:    cfg.LBEjectThreshold,
+		ejectDuration:     cfg.LBEjectDuration,
+		wake:              make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+
+	var instances []*instance
+	for _, raw := range cfg.BackendURLs {
+		target, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid backend URL %q: scheme and host are required", raw)
+		}
+		p.targets = append(p.targets, target)
+		transport := upstream
+		if p.discovery && target.Scheme == "https" && upstream.TLSClientConfig.ServerName == "" {
+			transport = upstream.Clone()
+			transport.TLSClientConfig.ServerName = target.Hostname()
+		}
+		p.transports[target.Host] = transport
+		instances = append(instances, newInstance(target, target.Host, transport))
+	}
+
+	// With DNS discovery the instances are the resolved addresses, so start
+	// empty and resolve synchronously before serving traffic.
+	if p.discovery {
+		instances = nil
+		p.instances.Store(&instances)
+		p.refresh()
+	} else {
+		p.instances.Store(&instances)
+	}
+
+	return p, nil
+}
+
+// primary returns the first configured backend, used as the placeholder
+// target before an instance is picked.
+func (p *pool) primary() *url.URL {
+	return p.targets[0]
+}
+
+func (p *pool) list() []*instance {
+	return *p.instances.Load()
+}
+
+// up reports whether any instance is passing active health checks.
+func (p *pool) up() bool {
+	return slices.ContainsFunc(p.list(), (*instance).isUp)
+}
+
+// pick chooses an instance for the next attempt of req, preferring available
+// instances that haven't been tried yet. If every instance is down or
+// ejected it still returns one: attempting a request beats failing outright.
+func (p *pool) pick(req *http.Request, tried map[*instance]bool) (*instance, error) {
+	all := p.list()
+	if len(all) == 0 {
+		return nil, errNoInstances
+	}
+
+	now := time.Now()
+	filters := []func(*instance) bool{
+		func(i *instance) bool { return i.available(now) && !tried[i] },
+		func(i *instance) bool { return i.available(now) },
+		func(i *instance) bool { return !tried[i] },
+	}
+
+	candidates := all
+	for _, keep := range filters {
+		var filtered []*instance
+		for _, inst := range all {
+			if keep(inst) {
+				filtered = append(filtered, inst)
+			}
+		}
+		if len(filtered) > 0 {
+			candidates = filtered
+			break
+		}
+	}
+
+	switch p.strategy {
+	case config.LBLeastConn:
+		best := candidates[0]
+		for _, inst := range candidates[1:] {
+			if inst.active.Load() < best.active.Load() {
+				best = inst
+			}
+		}
+		return best, nil
+	case config.LBConsistentHash:
+		return rendezvous(candidates, hashKey(req)), nil
+	default:
+		n := p.next.Add(1) - 1
+		return candidates[n%uint64(len(candidates))], nil
+	}
+}
+
+// hashKey returns the key used for consistent hashing: the authenticated user
+// when there is one, otherwise the client IP.
+func hashKey(req *http.Request) string {
+	if sess := auth.GetSessionFromContext(req.Context()); sess != nil {
+		return sess.UserID
+	}
+	return httpx.ClientIP(req)
+}
+
+// rendezvous picks the instance with the highest hash for key (highest random
+// weight hashing), so adding or removing an instance only remaps the keys
+// that belonged to it.
+func rendezvous(candidates []*instance, key string) *instance {
+	var (
+		best      *instance
+		bestScore uint64
+	)
+	for _, inst := range candidates {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		io.WriteString(h, inst.target.Host)
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = inst, score
+		}
+	}
+	return best
+}
+
+// recordResult updates passive health for inst after an attempt, ejecting it
+// for ejectDuration after ejectThreshold consecutive failures.
+func (p *pool) recordResult(inst *instance, failed bool) {
+	if p.ejectThreshold == 0 {
+		return
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	if !failed {
+		inst.failures = 0
+		return
+	}
+
+	inst.failures++
+	if inst.failures >= p.ejectThreshold {
+		inst.failures = 0
+		inst.ejectedUntil = time.Now().Add(p.ejectDuration)
+		slog.Warn("upstream instance ejected", "instance", inst.target.Host, "duration", p.ejectDuration)
+	}
+}
+
+// start runs DNS discovery in the background, if enabled.
+func (p *pool) start() {
+	if !p.discovery {
+		close(p.done)
+		return
+	}
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.discoveryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			case <-p.wake:
+			}
+			p.refresh()
+		}
+	}()
+}
+
+func (p *pool) close() {
+	close(p.stop)
+	<-p.done
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// Wake requests an immediate DNS refresh when discovery is enabled.
+func (p *pool) Wake() {
+	if !p.discovery {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// refresh resolves every backend hostname to its A/AAAA records and replaces
+// the instance list, keeping the state of addresses that are still present.
+// If a lookup fails, the previous instances for that backend are kept.
+func (p *pool) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	previous := make(map[string]*instance)
+	for _, inst := range p.list() {
+		previous[inst.target.Host] = inst
+	}
+
+	var (
+		instances []*instance
+		changed   bool
+	)
+	for _, target := range p.targets {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target.Hostname())
+		if err != nil {
+			slog.Warn("upstream discovery failed", "host", target.Hostname(), "error", err)
+			for _, inst := range previous {
+				if inst.host == target.Host {
+					instances = append(instances, inst)
+				}
+			}
+			continue
+		}
+
+		port := target.Port()
+		if port == "" {
+			port = "80"
+			if target.Scheme == "https" {
+				port = "443"
+			}
+		}
+
+		for _, addr := range addrs {
+			resolved := *target
+			resolved.Host = net.JoinHostPort(addr.IP.String(), port)
+			if inst, ok := previous[resolved.Host]; ok {
+				instances = append(instances, inst)
+				continue
+			}
+			instances = append(instances, newInstance(&resolved, target.Host, p.transports[target.Host]))
+			changed = true
+		}
+	}
+
+	if changed || len(instances) != len(previous) {
+		hosts := make([]string, len(instances))
+		for i, inst := range instances {
+			hosts[i] = inst.target.Host
+		}
+		slog.Info("upstream instances updated", "instances", hosts)
+	}
+
+	p.instances.Store(&instances)
+}
+
+type attemptsKey struct{}
+
+// attempts records which instances a request has already been sent to, so
+// retries can move to a different instance.
+type attempts struct {
+	mu    sync.Mutex
+	tried map[*instance]bool
+}
+
+func withAttempts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, &attempts{tried: make(map[*instance]bool)})
+}
+
+// balancerTransport sends each attempt to an instance picked from the pool.
+type balancerTransport struct {
+	pool *pool
+}
+
+func (t *balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	att, _ := req.Context().Value(attemptsKey{}).(*attempts)
+
+	var tried map[*instance]bool
+	if att != nil {
+		att.mu.Lock()
+		tried = maps.Clone(att.tried)
+		att.mu.Unlock()
+	}
+
+	inst, err := t.pool.pick(req, tried)
+	if err != nil {
+		return nil, err
+	}
+	if att != nil {
+		att.mu.Lock()
+		att.tried[inst] = true
+		att.mu.Unlock()
+	}
+
+	if slog.Default().Enabled(req.Context(), slog.LevelDebug) {
+		slog.Debug("upstream selected", "instance", inst.target.Host, "strategy", t.pool.strategy)
+
+		// Without discovery, resolve and log the upstream IP(s) too. This runs
+		// a fresh DNS lookup on every request, so it reflects any IP changes
+		// due to Railway service sleep/wake cycles.
+		if !t.pool.discovery {
+			if addrs, err := net.LookupHost(inst.target.Hostname()); err == nil {
+				slog.Debug("upstream resolved", "host", inst.target.Host, "ips", addrs)
+			}
+		}
+	}
+
+	inst.active.Add(1)
+	resp, err := inst.RoundTrip(req)
+	if err != nil {
+		inst.active.Add(-1)
+		if !isClientError(req, err) {
+			t.pool.recordResult(inst, true)
+		}
+		return nil, err
+	}
+
+	t.pool.recordResult(inst, isUpstreamFailure(resp.StatusCode))
+	resp.Body = trackBody(resp.Body, func() { inst.active.Add(-1) })
+	return resp, nil
+}
+
+// isUpstreamFailure reports whether a response status indicates the instance
+// itself is unhealthy, as opposed to an application-level error.
+func isUpstreamFailure(code int) bool {
+	return code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// isClientError reports whether err was caused by the client rather than the
+// instance: the client went away, its body was too large, or the request's
+// own deadline passed. These mustn't count towards ejecting the instance.
+func isClientError(req *http.Request, err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.Is(err, context.Canceled) || errors.As(err, &tooLarge) || req.Context().Err() != nil
+}
+
+// trackBody wraps body so onClose runs exactly once when it is closed. Bodies
+// of 101 Switching Protocols responses are io.ReadWriteClosers, which the
+// reverse proxy relies on for WebSocket upgrades, so that is preserved.
+func trackBody(body io.ReadCloser, onClose func()) io.ReadCloser {
+	var once sync.Once
+	done := func() { once.Do(onClose) }
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &trackedReadWriteCloser{ReadWriteCloser: rwc, done: done}
+	}
+	return &trackedReadCloser{ReadCloser: body, done: done}
+}
+
+type trackedReadCloser struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *trackedReadCloser) Close() error {
+	defer b.done()
+	return b.ReadCloser.Close()
+}
+
+type trackedReadWriteCloser struct {
+	io.ReadWriteCloser
+	done func()
+}
+
+func (b *trackedReadWriteCloser) Close() error {
+	defer b.done()
+	return b.ReadWriteCloser.Close()
+}
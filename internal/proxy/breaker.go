@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without contacting the backend while the
+// circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops sending requests to a backend that keeps failing.
+//
+// It opens after failureThreshold consecutive failures and rejects requests
+// for cooldown. It then moves to half-open and lets a single trial request
+// through at a time; successThreshold consecutive successes close it again,
+// and any failure reopens it.
+type circuitBreaker struct {
+	failureThreshold int
+	successThreshold int
+	cooldown         time.Duration
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	trial     bool // a half-open trial request is in flight
+}
+
+func newCircuitBreaker(failureThreshold, successThreshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		successThreshold: successThreshold,
+		cooldown:         cooldown,
+	}
+}
+
+// allow reports whether a request may be sent, and whether it is the
+// half-open trial request. Every allowed request must be followed by done.
+func (b *circuitBreaker) allow() (ok, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.trial {
+			return false, false
+		}
+		b.trial = true
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+type breakerResult int
+
+const (
+	resultSuccess breakerResult = iota
+	resultFailure
+	resultIgnored // e.g. the client went away; says nothing about the backend
+)
+
+// done records the outcome of a request that allow let through.
+func (b *circuitBreaker) done(trial bool, result breakerResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial {
+		b.trial = false
+	}
+
+	switch result {
+	case resultSuccess:
+		b.failures = 0
+		if trial && b.state == breakerHalfOpen {
+			b.successes++
+			if b.successes >= b.successThreshold {
+				b.setState(breakerClosed)
+			}
+		}
+	case resultFailure:
+		b.failures++
+		if (trial && b.state == breakerHalfOpen) || (b.state == breakerClosed && b.failures >= b.failureThreshold) {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// isOpen reports whether requests are currently being rejected.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && time.Since(b.openedAt) < b.cooldown
+}
+
+// State returns the current state and, when open, how long until the next
+// trial request is allowed.
+func (b *circuitBreaker) State() (breakerState, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		return b.state, max(b.cooldown-time.Since(b.openedAt), 0)
+	}
+	return b.state, 0
+}
+
+// setState transitions the breaker and logs the change. b.mu must be held.
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+
+	from := b.state
+	b.state = state
+	b.successes = 0
+	switch state {
+	case breakerOpen:
+		b.openedAt = time.Now()
+		slog.Warn("circuit breaker opened", "from", from.String(), "failures", b.failures, "cooldown", b.cooldown)
+	case breakerHalfOpen:
+		slog.Info("circuit breaker half-open", "from", from.String())
+	case breakerClosed:
+		b.failures = 0
+		slog.Info("circuit breaker closed", "from", from.String())
+	}
+}
+
+// breakerTransport fails fast with errCircuitOpen while the breaker is open
+// and feeds the outcome of every request (after retries) back into it.
+type breakerTransport struct {
+	wrapped http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ok, trial := t.breaker.allow()
+	if !ok {
+		return nil, errCircuitOpen
+	}
+
+	resp, err := t.wrapped.RoundTrip(req)
+	switch {
+	case err != nil && (errors.Is(err, context.Canceled) || errors.Is(err, errCircuitOpen)):
+		t.breaker.done(trial, resultIgnored)
+	case err != nil:
+		t.breaker.done(trial, resultFailure)
+	case isUpstreamFailure(resp.StatusCode):
+		t.breaker.done(trial, resultFailure)
+	default:
+		t.breaker.done(trial, resultSuccess)
+	}
+	return resp, err
+}
@@ -0,0 +1,381 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"turnstile/internal/auth"
+)
+
+// cacheableStatus lists the response codes stored by the cache.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheTransport serves GET requests from a cache of backend responses,
+// following Cache-Control, ETag, Last-Modified and Vary. Responses are
+// stored per user unless the backend marks them public, so authenticated
+// content is never shared between users.
+type cacheTransport struct {
+	wrapped       http.RoundTripper
+	store         *cacheStore
+	maxObjectSize int64
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		resp, err := t.wrapped.RoundTrip(req)
+		// A successful unsafe request may have changed the resource.
+		if err == nil && !isSafeMethod(req.Method) && resp.StatusCode < 400 {
+			t.store.invalidateURI(req.URL.RequestURI())
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header.Values("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok || req.Header.Get("Range") != "" {
+		return t.wrapped.RoundTrip(req)
+	}
+
+	uri := req.URL.RequestURI()
+	user := cacheUser(req)
+
+	entry := t.lookup(req, publicCacheKey(uri))
+	if entry == nil {
+		entry = t.lookup(req, userCacheKey(uri, user))
+	}
+
+	now := time.Now()
+	_, noCache := reqCC["no-cache"]
+	if maxAge, ok := reqCC["max-age"]; ok && maxAge == "0" {
+		noCache = true
+	}
+
+	if entry != nil && entry.fresh(now) && !noCache {
+		if resp, err := t.serve(req, entry, "hit"); err == nil {
+			return resp, nil
+		}
+	}
+
+	// Revalidate a stale entry with the backend when it has validators.
+	outreq := req
+	etag, lastModified := entry.validators()
+	if etag != "" || lastModified != "" {
+		outreq = req.Clone(req.Context())
+		outreq.Header.Del("If-None-Match")
+		outreq.Header.Del("If-Modified-Since")
+		if etag != "" {
+			outreq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			outreq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := t.wrapped.RoundTrip(outreq)
+	if err != nil {
+		return nil, err
+	}
+
+	if outreq != req && resp.StatusCode == http.StatusNotModified {
+		drainAndClose(resp.Body)
+		header := entry.header.Clone()
+		for name, values := range resp.Header {
+			header[name] = values
+		}
+		cc := parseCacheControl(header.Values("Cache-Control"))
+		updated := t.store.revalidated(entry, header, upstreamAge(resp.Header), freshness(cc, header, entry.key == publicCacheKey(uri)))
+		if resp, err := t.serve(req, updated, "fwd=stale; fwd-status=304"); err == nil {
+			return resp, nil
+		}
+		// The entry was evicted meanwhile; fetch it again.
+		resp, err = t.wrapped.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t.maybeStore(req, resp, uri, user)
+}
+
+// lookup returns the entry for key if its Vary headers match req.
+func (t *cacheTransport) lookup(req *http.Request, key string) *cacheEntry {
+	entry := t.store.get(key)
+	if entry == nil {
+		return nil
+	}
+	for name, value := range entry.vary {
+		if strings.Join(req.Header.Values(name), ", ") != value {
+			return nil
+		}
+	}
+	return entry
+}
+
+// serve builds a response from a cache entry, answering the client's own
+// conditional request with 304 Not Modified when it matches.
+func (t *cacheTransport) serve(req *http.Request, entry *cacheEntry, status string) (*http.Response, error) {
+	header := entry.header.Clone()
+	header.Set("Age", strconv.Itoa(int(entry.currentAge(time.Now()).Seconds())))
+	header.Set("Cache-Status", "turnstile; "+status)
+
+	resp := &http.Response{
+		Status:     strconv.Itoa(entry.status) + " " + http.StatusText(entry.status),
+		StatusCode: entry.status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+	}
+
+	if notModified(req, header) {
+		resp.Status = "304 " + http.StatusText(http.StatusNotModified)
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		header.Del("Content-Length")
+		return resp, nil
+	}
+
+	body, err := t.store.open(entry)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = body
+	resp.ContentLength = entry.length
+	header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	return resp, nil
+}
+
+// maybeStore stores resp if it may be cached, returning a response that
+// reads the same body.
+func (t *cacheTransport) maybeStore(req *http.Request, resp *http.Response, uri, user string) (*http.Response, error) {
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+	key, ok := t.storeKey(req, resp, cc, uri, user)
+	if !ok {
+		resp.Header.Set("Cache-Status", "turnstile; fwd=uri-miss")
+		return resp, nil
+	}
+
+	entry := &cacheEntry{
+		key:      key,
+		uri:      uri,
+		status:   resp.StatusCode,
+		header:   resp.Header.Clone(),
+		vary:     make(map[string]string),
+		stored:   time.Now(),
+		age:      upstreamAge(resp.Header),
+		freshFor: freshness(cc, resp.Header, key == publicCacheKey(uri)),
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		entry.vary[name] = strings.Join(req.Header.Values(name), ", ")
+	}
+
+	// The body streams to the client as it arrives; the entry is stored once
+	// it has been read to the end, if it fit.
+	resp.Body = &cacheFill{ReadCloser: resp.Body, store: t.store, entry: entry, buf: new(bytes.Buffer), max: t.maxObjectSize}
+	resp.Header.Set("Cache-Status", "turnstile; fwd=uri-miss")
+	return resp, nil
+}
+
+// cacheFill passes a response body through while keeping a copy of it, and
+// stores entry with that copy when the body reaches EOF. A body that grows
+// past max is passed through without being kept.
+type cacheFill struct {
+	io.ReadCloser
+	store *cacheStore
+	entry *cacheEntry
+	buf   *bytes.Buffer // nil once the body is stored or too large
+	max   int64
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if f.buf == nil {
+		return n, err
+	}
+	if int64(f.buf.Len()+n) > f.max {
+		f.buf = nil
+		return n, err
+	}
+	f.buf.Write(p[:n])
+	if err == io.EOF {
+		f.entry.length = int64(f.buf.Len())
+		if perr := f.store.put(f.entry, f.buf.Bytes()); perr != nil {
+			slog.Debug("failed to store cached response", "uri", f.entry.uri, "error", perr)
+		}
+		f.buf = nil
+	}
+	return n, err
+}
+
+// storeKey decides whether resp may be stored and under which key: the
+// shared key for public responses, otherwise the requesting user's key.
+// Anonymous responses that are private, or to requests carrying cookies or
+// credentials, are not stored, since the backend may have personalized them.
+func (t *cacheTransport) storeKey(req *http.Request, resp *http.Response, cc map[string]string, uri, user string) (string, bool) {
+	_, noStore := cc["no-store"]
+	switch {
+	case !cacheableStatus[resp.StatusCode],
+		noStore,
+		resp.Header.Get("Set-Cookie") != "",
+		slices.Contains(varyHeaders(resp.Header), "*"),
+		resp.ContentLength > t.maxObjectSize,
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		return "", false
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	_, public := cc["public"]
+	if freshness(cc, resp.Header, public) == 0 && etag == "" && lastModified == "" {
+		// Nothing to gain: it would have to be fetched again anyway.
+		return "", false
+	}
+
+	if public {
+		return publicCacheKey(uri), true
+	}
+	_, private := cc["private"]
+	if user == "" && (private || req.Header.Get("Cookie") != "" || req.Header.Get("Authorization") != "") {
+		return "", false
+	}
+	return userCacheKey(uri, user), true
+}
+
+// cacheUser identifies the signed-in user for per-user cache keys; "" for
+// anonymous requests on public routes.
+func cacheUser(req *http.Request) string {
+	if sess := auth.GetSessionFromContext(req.Context()); sess != nil {
+		return sess.UserID
+	}
+	return ""
+}
+
+func publicCacheKey(uri string) string {
+	return "public\x00" + uri
+}
+
+func userCacheKey(uri, user string) string {
+	return "user\x00" + user + "\x00" + uri
+}
+
+// validators returns the entry's ETag and Last-Modified, if any.
+func (e *cacheEntry) validators() (etag, lastModified string) {
+	if e == nil {
+		return "", ""
+	}
+	return e.header.Get("ETag"), e.header.Get("Last-Modified")
+}
+
+// parseCacheControl parses Cache-Control directives into a map of lowercase
+// names to (unquoted) values.
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// freshness returns how long a response may be served without revalidation:
+// s-maxage (for shared entries), max-age, or Expires relative to Date.
+// no-cache responses are stored but always revalidated.
+func freshness(cc map[string]string, header http.Header, shared bool) time.Duration {
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if shared {
+		if d, ok := seconds(cc["s-maxage"]); ok {
+			return d
+		}
+	}
+	if d, ok := seconds(cc["max-age"]); ok {
+		return d
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(exp.Sub(date), 0)
+	}
+	return 0
+}
+
+func seconds(value string) (time.Duration, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// upstreamAge returns the Age header of a backend response.
+func upstreamAge(header http.Header) time.Duration {
+	d, _ := seconds(header.Get("Age"))
+	return d
+}
+
+// varyHeaders returns the request header names listed in Vary.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// notModified reports whether the client's conditional request matches the
+// cached response.
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead ||
+		method == http.MethodOptions || method == http.MethodTrace
+}
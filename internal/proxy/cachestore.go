@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"turnstile/internal/config"
+)
+
+// cacheEntry is a stored response. Its metadata always lives in memory; the
+// body is held in memory, or in a file when the cache is on disk.
+type cacheEntry struct {
+	key    string
+	uri    string // request URI, for invalidation
+	status int
+	header http.Header
+	vary   map[string]string // request header values the response varies on
+
+	stored   time.Time     // when the response was received or revalidated
+	age      time.Duration // upstream Age at that time
+	freshFor time.Duration // freshness lifetime; 0 means always revalidate
+
+	length int64  // body length
+	size   int64  // approximate memory or disk used, for the size bound
+	body   []byte // in-memory body
+	file   string // on-disk body
+
+	elem *list.Element
+}
+
+// currentAge is the entry's age as sent in the Age header.
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.currentAge(now) < e.freshFor
+}
+
+// cacheStore is a size-bounded LRU of cache entries.
+type cacheStore struct {
+	maxSize int64
+	dir     string // empty for an in-memory store
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // front is most recently used
+	entries map[string]*cacheEntry
+	byURI   map[string]map[string]bool // request URI -> entry keys
+}
+
+// cacheFilePattern matches the directories on-disk stores are created in.
+const cacheFilePattern = "turnstile-cache-*"
+
+// newCacheStore returns an in-memory store, or an on-disk one in a fresh
+// directory under dir.
+func newCacheStore(maxSize int64, dir string) (*cacheStore, error) {
+	s := &cacheStore{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*cacheEntry),
+		byURI:   make(map[string]map[string]bool),
+	}
+	if dir != "" {
+		var err error
+		if s.dir, err = os.MkdirTemp(dir, cacheFilePattern); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Cache is the response cache shared by every proxy handler built from one
+// config, so that CacheMaxSize bounds them together rather than per route.
+type Cache struct {
+	store *cacheStore
+}
+
+// NewCache returns the response cache for cfg, or nil if caching is off.
+func NewCache(cfg *config.Config) (*Cache, error) {
+	if !cfg.Cache {
+		return nil, nil
+	}
+	store, err := newCacheStore(int64(cfg.CacheMaxSize), cfg.CacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("create response cache: %w", err)
+	}
+	return &Cache{store: store}, nil
+}
+
+// Close removes the cache's directory, if any.
+func (c *Cache) Close() error {
+	c.store.close()
+	return nil
+}
+
+// ClearCacheDir removes cache directories left under dir by a previous run.
+// Call it at startup, before any store is created.
+func ClearCacheDir(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, cacheFilePattern))
+	for _, path := range matches {
+		if err := os.RemoveAll(path); err != nil {
+			slog.Warn("failed to remove stale cache directory", "path", path, "error", err)
+		}
+	}
+}
+
+// get returns the entry for key and marks it recently used.
+func (s *cacheStore) get(key string) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[key]
+	if e != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	return e
+}
+
+// put stores e with body, replacing any entry with the same key and
+// evicting the least recently used entries to stay within maxSize.
+func (s *cacheStore) put(e *cacheEntry, body []byte) error {
+	e.size = int64(len(body)) + headerSize(e.header)
+	if e.size > s.maxSize {
+		return nil
+	}
+
+	if s.dir == "" {
+		e.body = body
+	} else {
+		// Each entry gets its own file, so a response being served from a
+		// replaced or evicted entry keeps reading its own body.
+		f, err := os.CreateTemp(s.dir, "entry-*")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		e.file = f.Name()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.entries[e.key]; old != nil {
+		s.removeLocked(old)
+	}
+	e.elem = s.lru.PushFront(e)
+	s.entries[e.key] = e
+	if s.byURI[e.uri] == nil {
+		s.byURI[e.uri] = make(map[string]bool)
+	}
+	s.byURI[e.uri][e.key] = true
+	s.size += e.size
+
+	for s.size > s.maxSize {
+		s.removeLocked(s.lru.Back().Value.(*cacheEntry))
+	}
+	return nil
+}
+
+// revalidated replaces e with a copy carrying the metadata of a successful
+// revalidation, keeping its body. Entries are never modified once stored,
+// so they can be read without holding the lock.
+func (s *cacheStore) revalidated(e *cacheEntry, header http.Header, age, freshFor time.Duration) *cacheEntry {
+	updated := *e
+	updated.header = header
+	updated.stored = time.Now()
+	updated.age = age
+	updated.freshFor = freshFor
+	updated.size = e.size - headerSize(e.header) + headerSize(header)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[e.key] != e {
+		// Replaced or evicted meanwhile.
+		return &updated
+	}
+	updated.elem.Value = &updated
+	s.entries[e.key] = &updated
+	s.size += updated.size - e.size
+	return &updated
+}
+
+// invalidateURI removes every entry stored for uri.
+func (s *cacheStore) invalidateURI(uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.byURI[uri] {
+		s.removeLocked(s.entries[key])
+	}
+}
+
+func (s *cacheStore) removeLocked(e *cacheEntry) {
+	if s.entries[e.key] != e {
+		return
+	}
+	s.lru.Remove(e.elem)
+	delete(s.entries, e.key)
+	delete(s.byURI[e.uri], e.key)
+	if len(s.byURI[e.uri]) == 0 {
+		delete(s.byURI, e.uri)
+	}
+	s.size -= e.size
+	if e.file != "" {
+		os.Remove(e.file)
+	}
+}
+
+// open returns the entry's body. An on-disk body stays readable if the entry
+// is evicted while it is being read, but opening fails if it was evicted
+// before.
+func (s *cacheStore) open(e *cacheEntry) (io.ReadCloser, error) {
+	if e.file == "" {
+		return io.NopCloser(bytes.NewReader(e.body)), nil
+	}
+	return os.Open(e.file)
+}
+
+// close removes the store's directory, if any.
+func (s *cacheStore) close() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// headerSize approximates the memory used by h.
+func headerSize(h http.Header) int64 {
+	var n int64
+	for name, values := range h {
+		for _, v := range values {
+			n += int64(len(name) + len(v))
+		}
+	}
+	return n
+}
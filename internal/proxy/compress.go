@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"turnstile/internal/config"
+)
+
+// brotliLevel trades some compression ratio for speed; the maximum level is
+// far too slow for on-the-fly compression.
+const brotliLevel = 5
+
+// zstdWindowSize is the largest window browsers must support for zstd
+// content encoding (RFC 9659).
+const zstdWindowSize = 8 << 20
+
+// encoder is implemented by the gzip, brotli and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressor compresses proxied responses the backend sent uncompressed.
+type compressor struct {
+	encodings []string // in order of preference
+	minSize   int64
+	types     []string
+	pools     map[string]*sync.Pool
+}
+
+// newCompressor returns nil if compression is disabled.
+func newCompressor(cfg *config.Config) *compressor {
+	if !cfg.Compression {
+		return nil
+	}
+	return &compressor{
+		encodings: cfg.CompressionEncodings,
+		minSize:   int64(cfg.CompressionMinSize),
+		types:     cfg.CompressionTypes,
+		pools: map[string]*sync.Pool{
+			config.EncodingGzip: {New: func() any {
+				return gzip.NewWriter(nil)
+			}},
+			config.EncodingBrotli: {New: func() any {
+				return brotli.NewWriterLevel(nil, brotliLevel)
+			}},
+			config.EncodingZstd: {New: func() any {
+				// Only fails on invalid options.
+				enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+				return enc
+			}},
+		},
+	}
+}
+
+// compress replaces the response body with a compressed stream if the client
+// accepts one of the configured encodings and the response is worth
+// compressing.
+func (c *compressor) compress(resp *http.Response) {
+	if !c.shouldCompress(resp) {
+		return
+	}
+	encoding := negotiateEncoding(resp.Request.Header.Get("Accept-Encoding"), c.encodings)
+	if encoding == "" {
+		return
+	}
+
+	pool := c.pools[encoding]
+	enc := pool.Get().(encoder)
+	pr, pw := io.Pipe()
+	enc.Reset(pw)
+
+	// Flush after every read when the length is unknown, so streamed
+	// responses (long polling, NDJSON) aren't held back by the encoder.
+	streaming := resp.ContentLength < 0
+	src := resp.Body
+	go func() {
+		defer pool.Put(enc)
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, werr := enc.Write(buf[:n]); werr != nil {
+					pw.CloseWithError(werr)
+					enc.Reset(io.Discard)
+					return
+				}
+				if streaming {
+					if ferr := enc.Flush(); ferr != nil {
+						pw.CloseWithError(ferr)
+						enc.Reset(io.Discard)
+						return
+					}
+				}
+			}
+			if err == io.EOF {
+				pw.CloseWithError(enc.Close())
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				enc.Reset(io.Discard)
+				return
+			}
+		}
+	}()
+
+	resp.Body = &compressedBody{PipeReader: pr, src: src}
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The compressed bytes differ from the backend's representation.
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	if !slices.ContainsFunc(resp.Header.Values("Vary"), func(v string) bool {
+		return strings.Contains(strings.ToLower(v), "accept-encoding")
+	}) {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// shouldCompress reports whether resp is an uncompressed, compressible,
+// non-streaming response of at least the minimum size. Server-sent events
+// and protocol upgrades (WebSockets) are never compressed.
+func (c *compressor) shouldCompress(resp *http.Response) bool {
+	req := resp.Request
+	switch {
+	case req.Method == http.MethodHead,
+		req.Header.Get("Upgrade") != "",
+		resp.StatusCode < http.StatusOK,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent,
+		resp.StatusCode == http.StatusNotModified,
+		resp.Header.Get("Content-Range") != "",
+		resp.Header.Get("Content-Encoding") != "" && !strings.EqualFold(resp.Header.Get("Content-Encoding"), "identity"),
+		strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform"):
+		return false
+	case resp.ContentLength >= 0 && resp.ContentLength < c.minSize:
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, typ := range c.types {
+		if prefix, ok := strings.CutSuffix(typ, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the offered encoding with the highest quality in
+// the Accept-Encoding header, preferring earlier offers on ties. It returns
+// "" if the client accepts none of them.
+func negotiateEncoding(accept string, offered []string) string {
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		quality[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range offered {
+		q, ok := quality[enc]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressedBody is the compressed response body. Closing it also closes
+// the backend's body, which stops the compressing goroutine.
+type compressedBody struct {
+	*io.PipeReader
+	src io.ReadCloser
+}
+
+func (b *compressedBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
@@ -3,157 +3,96 @@ package proxy
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
-	"math"
-	"math/rand"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"time"
 
 	"turnstile/internal/auth"
+	"turnstile/internal/config"
+	"turnstile/internal/health"
+	"turnstile/internal/problem"
+	"turnstile/internal/views"
 )
 
-// maxBackoffDelay is the maximum delay between retry attempts.
-const maxBackoffDelay = 10 * time.Second
+// defaultRetryAfter is the Retry-After hint sent when active health checking
+// is disabled and DNS discovery has found no instances. Without health
+// checks a backend that can't be reached gets a plain Bad Gateway instead.
+const defaultRetryAfter = 5 * time.Second
 
-// idempotentMethods is the set of HTTP methods that are safe to retry
-// without risk of duplicate side effects on the upstream.
-var idempotentMethods = map[string]bool{
-	http.MethodGet:     true,
-	http.MethodHead:    true,
-	http.MethodOptions: true,
-	http.MethodPut:     true,
-}
-
-// retryTransport wraps an http.RoundTripper and retries requests on
-// connection-level errors for idempotent HTTP methods.
-type retryTransport struct {
-	wrapped    http.RoundTripper
-	maxRetries int
-	baseDelay  time.Duration
+type Handler struct {
+	reverseProxy *httputil.ReverseProxy
+	renderer     *views.Renderer
+	problems     *problem.Writer
+	pool         *pool
+	monitor      *healthMonitor
+	breaker      *circuitBreaker
+	retryAfter   time.Duration
+	defaults     routeOptions
+	publicURL    *url.URL
+	compressor   *compressor
 }
 
-func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if !idempotentMethods[req.Method] {
-		return t.wrapped.RoundTrip(req)
-	}
-
-	// If the request has a body but no way to replay it, fall back to a single
-	// attempt to avoid sending an empty body on retry.
-	if req.Body != nil && req.GetBody == nil {
-		return t.wrapped.RoundTrip(req)
+// NewHandler returns a proxy to cfg's backends. Responses are cached in
+// cache unless it is nil.
+func NewHandler(cfg *config.Config, renderer *views.Renderer, cache *Cache) (*Handler, error) {
+	upstream, err := newUpstreamTransport(cfg.Upstream)
+	if err != nil {
+		return nil, err
 	}
 
-	var (
-		resp *http.Response
-		err  error
-	)
-
-	// Sanitize the URL for logging: strip query string and fragment to avoid
-	// leaking sensitive parameters into log output.
-	sanitizedURL := *req.URL
-	sanitizedURL.RawQuery = ""
-	sanitizedURL.Fragment = ""
-	logURL := sanitizedURL.String()
-
-	for attempt := 0; attempt <= t.maxRetries; attempt++ {
-		// Reset the body before each attempt so retries don't send an empty body.
-		if req.GetBody != nil {
-			body, gbErr := req.GetBody()
-			if gbErr != nil {
-				return nil, gbErr
-			}
-			req.Body = body
-		}
-
-		resp, err = t.wrapped.RoundTrip(req)
-		if err == nil {
-			return resp, nil
-		}
-
-		// Only retry on connection-level errors (dial failures, connection
-		// refused, etc.) — not on successful HTTP responses, even 5xx, since
-		// those mean the upstream received the request.
-		if !isConnectionError(err) {
-			return nil, err
-		}
-
-		if attempt < t.maxRetries {
-			delay := t.backoff(attempt)
-			// Add ±20% jitter to avoid synchronized retries across instances.
-			jitter := time.Duration(float64(delay) * 0.2 * (rand.Float64()*2 - 1))
-			delay += jitter
-			slog.Warn("retrying upstream",
-				"method", req.Method,
-				"url", logURL,
-				"attempt", attempt+1,
-				"max_retries", t.maxRetries,
-				"attempts_remaining", t.maxRetries-attempt-1,
-				"delay", delay,
-				"error", err,
-			)
-
-			// Respect request context cancellation during backoff.
-			select {
-			case <-req.Context().Done():
-				return nil, context.Cause(req.Context())
-			case <-time.After(delay):
-			}
-		}
+	pool, err := newPool(cfg, upstream)
+	if err != nil {
+		return nil, err
 	}
+	target := pool.primary()
 
-	slog.Error("upstream retries exhausted",
-		"method", req.Method,
-		"url", logURL,
-		"total_attempts", t.maxRetries+1,
-		"error", err,
-	)
-	return nil, err
-}
-
-// backoff returns an exponential backoff duration capped at maxBackoffDelay.
-func (t *retryTransport) backoff(attempt int) time.Duration {
-	multiplier := math.Pow(2, float64(attempt))
-	delay := time.Duration(float64(t.baseDelay) * multiplier)
-	if delay > maxBackoffDelay {
-		delay = maxBackoffDelay
+	publicURL, err := url.Parse(cfg.PublicURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public URL: %w", err)
 	}
-	return delay
-}
 
-// isConnectionError reports whether err is a connection-level failure
-// (dial error, connection refused, etc.) rather than a higher-level error.
-// errors.As unwraps through any intermediate types (including *url.Error),
-// so this catches raw transport errors that aren't wrapped in *url.Error.
-func isConnectionError(err error) bool {
-	if err == nil {
-		return false
+	h := &Handler{
+		renderer:   renderer,
+		problems:   problem.NewWriter(renderer),
+		pool:       pool,
+		retryAfter: defaultRetryAfter,
+		defaults: routeOptions{
+			maxBodySize:      int64(cfg.MaxRequestBodySize),
+			timeout:          cfg.UpstreamTimeout,
+			streamingTimeout: cfg.StreamingTimeout,
+			rewrite:          pathRewrite{strip: cfg.StripPrefix, add: cfg.AddPrefix},
+			requestHeaders:   []config.HeaderRules{cfg.RequestHeaders},
+			responseHeaders:  []config.HeaderRules{cfg.ResponseHeaders},
+		},
+		publicURL:  publicURL,
+		compressor: newCompressor(cfg),
 	}
-	var netErr *net.OpError
-	return errors.As(err, &netErr)
-}
 
-type Handler struct {
-	reverseProxy *httputil.ReverseProxy
-}
-
-func NewHandler(backendURL string, maxRetries int, retryDelay time.Duration) (*Handler, error) {
-	target, err := url.Parse(backendURL)
-	if err != nil {
-		return nil, err
+	pool.start()
+	if cfg.HealthCheckInterval > 0 {
+		h.monitor = newHealthMonitor(pool, cfg.HealthCheckPath, cfg.HealthCheckInterval, cfg.HealthCheckTimeout, cfg.HealthCheckThreshold)
+		h.retryAfter = max(cfg.HealthCheckInterval, time.Second)
+		h.monitor.start()
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
-
 	proxy.Director = func(req *http.Request) {
 		originalHost := req.Host
 
+		// The balancer transport replaces the host with the instance picked
+		// for each attempt; the primary target is only a placeholder.
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.Host = target.Host
 
+		opts := h.optionsFor(req.Context())
+		opts.rewrite.rewriteRequestPath(req.URL)
+		applyHeaderRules(req.Header, opts.requestHeaders)
+
 		if req.Header.Get("X-Forwarded-Host") == "" {
 			req.Header.Set("X-Forwarded-Host", originalHost)
 		}
@@ -161,41 +100,203 @@ func NewHandler(backendURL string, maxRetries int, retryDelay time.Duration) (*H
 			req.Header.Set("X-Forwarded-Proto", "https")
 		}
 
+		// Identity headers only ever come from Turnstile, never the client:
+		// on public routes there is no session to overwrite them.
+		req.Header.Del("X-Auth-Email")
+		req.Header.Del("X-Auth-User-ID")
+		req.Header.Del("X-Auth-Name")
 		session := auth.GetSessionFromContext(req.Context())
 		if session != nil {
 			req.Header.Set("X-Auth-Email", session.Email)
 			req.Header.Set("X-Auth-User-ID", session.UserID)
 			req.Header.Set("X-Auth-Name", session.Name)
 		}
-
-		// Resolve and log the upstream IP(s) at debug level. This runs a fresh
-		// DNS lookup on every request, so it reflects any IP changes due to
-		// Railway service sleep/wake cycles (no in-process DNS caching).
-		if slog.Default().Enabled(req.Context(), slog.LevelDebug) {
-			if addrs, err := net.LookupHost(target.Hostname()); err == nil {
-				slog.Debug("upstream resolved", "host", target.Host, "ips", addrs)
-			}
-		}
 	}
 
+	proxy.ModifyResponse = h.modifyResponse
+
 	// Flush immediately: fixes SSE workloads
 	proxy.FlushInterval = -1
 
-	proxy.Transport = &retryTransport{
-		wrapped:    http.DefaultTransport,
-		maxRetries: maxRetries,
-		baseDelay:  retryDelay,
+	retry := &retryTransport{
+		wrapped:     &balancerTransport{pool: pool},
+		maxRetries:  cfg.ProxyMaxRetries,
+		baseDelay:   cfg.ProxyRetryDelay,
+		retryStatus: make(map[int]bool),
+		budget:      cfg.ProxyRetryBudget,
+	}
+	for _, code := range cfg.ProxyRetryStatusCodes {
+		retry.retryStatus[code] = true
+	}
+
+	var transport http.RoundTripper = retry
+	if cfg.BreakerFailureThreshold > 0 {
+		h.breaker = newCircuitBreaker(cfg.BreakerFailureThreshold, cfg.BreakerSuccessThreshold, cfg.BreakerCooldown)
+		retry.breaker = h.breaker
+		transport = &breakerTransport{wrapped: transport, breaker: h.breaker}
+	}
+	if cache != nil {
+		transport = &cacheTransport{wrapped: transport, store: cache.store, maxObjectSize: int64(cfg.CacheMaxObjectSize)}
 	}
+	proxy.Transport = transport
 
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		slog.Error("proxy error", "method", r.Method, "path", r.URL.Path, "error", err)
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write([]byte("Bad Gateway"))
+
+		// The breaker is open: fail fast and tell the client when the next
+		// trial request will be let through.
+		if errors.Is(err, errCircuitOpen) {
+			_, remaining := h.breaker.State()
+			h.serveUnavailable(w, r, max(remaining, time.Second))
+			return
+		}
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.serveTooLarge(w, r, tooLarge.Limit)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() != nil {
+			h.problems.Write(w, r, problem.Details{
+				Status: http.StatusGatewayTimeout,
+				Code:   "gateway_timeout",
+				Detail: "proxy.timeout",
+			})
+			return
+		}
+
+		// The backend couldn't be reached even after retries: it is most
+		// likely asleep or restarting, so kick off a probe and show the
+		// waking page rather than a bare Bad Gateway.
+		if errors.Is(err, errNoInstances) || (isConnectionError(err) && h.monitor != nil) {
+			h.wake()
+			h.serveUnavailable(w, r, h.retryAfter)
+			return
+		}
+
+		h.problems.Write(w, r, problem.Details{
+			Status: http.StatusBadGateway,
+			Code:   "bad_gateway",
+			Detail: "proxy.bad_gateway",
+			Note:   "proxy.bad_gateway_note",
+		})
 	}
 
-	return &Handler{reverseProxy: proxy}, nil
+	h.reverseProxy = proxy
+	return h, nil
 }
 
 func (p *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	opts := p.optionsFor(r.Context())
+
+	if opts.maxBodySize > 0 {
+		if r.ContentLength > opts.maxBodySize {
+			p.serveTooLarge(w, r, opts.maxBodySize)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, opts.maxBodySize)
+	}
+
+	// Long-lived streams get their own timeout so they aren't cut off by
+	// the one meant for ordinary requests.
+	timeout := opts.timeout
+	if isStreamingRequest(r) {
+		timeout = opts.streamingTimeout
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if !p.pool.up() {
+		p.wake()
+		p.serveUnavailable(w, r, p.retryAfter)
+		return
+	}
 	p.reverseProxy.ServeHTTP(w, r)
 }
+
+// Close stops the background health checker and DNS discovery and closes
+// idle upstream connections.
+func (p *Handler) Close() error {
+	if p.monitor != nil {
+		p.monitor.close()
+	}
+	p.pool.close()
+	return nil
+}
+
+// ReadinessCheck returns a health check that passes if any upstream instance
+// answers path with expectedStatus (0 accepts any response below 500).
+func (p *Handler) ReadinessCheck(path string, expectedStatus int) health.CheckFunc {
+	return func(ctx context.Context) error {
+		instances := p.pool.list()
+		if len(instances) == 0 {
+			return errNoInstances
+		}
+
+		var errs []error
+		for _, inst := range instances {
+			err := probeInstance(ctx, inst, path, expectedStatus, 10*time.Second)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// BreakerStatus reports the circuit breaker state for the readiness report.
+// An open breaker marks the backend unavailable.
+func (p *Handler) BreakerStatus() (string, error) {
+	if p.breaker == nil {
+		return "disabled", nil
+	}
+	state, remaining := p.breaker.State()
+	if state == breakerOpen {
+		return state.String(), fmt.Errorf("circuit breaker open, next trial in %s", remaining.Round(time.Second))
+	}
+	return state.String(), nil
+}
+
+// wake asks for an immediate health probe and DNS refresh, so a backend that
+// is asleep or has moved is noticed as soon as possible.
+func (p *Handler) wake() {
+	if p.monitor != nil {
+		p.monitor.Wake()
+	}
+	p.pool.Wake()
+}
+
+// serveTooLarge rejects a request whose body exceeds limit bytes.
+func (p *Handler) serveTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	p.problems.Write(w, r, problem.Details{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    "request_too_large",
+		Detail:  "proxy.body_too_large",
+		Message: "proxy.body_limit",
+		Args:    []any{limit},
+	})
+}
+
+// serveUnavailable tells the client to come back after retryAfter with a
+// 503 and Retry-After; browsers get the auto-refreshing waking page.
+func (p *Handler) serveUnavailable(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if problem.Negotiate(r) != problem.HTML {
+		p.problems.Write(w, r, problem.Details{
+			Status: http.StatusServiceUnavailable,
+			Code:   "service_unavailable",
+			Detail: "proxy.starting",
+		})
+		return
+	}
+
+	p.renderer.RenderWakingPage(w, r, views.WakingPageData{RefreshSeconds: seconds})
+}
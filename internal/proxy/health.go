@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"turnstile/internal/health"
+)
+
+// healthMonitor actively probes every upstream instance and tracks whether
+// each is up. Instances start out as up so traffic flows before the first
+// probe completes; an instance is marked down after threshold consecutive
+// failed probes and back up after the first successful one.
+type healthMonitor struct {
+	pool      *pool
+	path      string
+	timeout   time.Duration
+	interval  time.Duration
+	threshold int
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newHealthMonitor(pool *pool, path string, interval, timeout time.Duration, threshold int) *healthMonitor {
+	return &healthMonitor{
+		pool:      pool,
+		path:      path,
+		timeout:   timeout,
+		interval:  interval,
+		threshold: threshold,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// newProbeClient returns a client for health probes that reports the
+// backend's own status instead of following redirects (e.g. to a login page).
+func newProbeClient(transport http.RoundTripper, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// start runs the probe loop in the background until close is called.
+func (m *healthMonitor) start() {
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		m.probeAll()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			case <-m.wake:
+			}
+			m.probeAll()
+		}
+	}()
+}
+
+func (m *healthMonitor) close() {
+	close(m.stop)
+	<-m.done
+}
+
+// Wake requests an immediate probe without waiting for the next tick. Probing
+// a sleeping Railway service over the private network is what wakes it up.
+func (m *healthMonitor) Wake() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *healthMonitor) probeAll() {
+	var wg sync.WaitGroup
+	for _, inst := range m.pool.list() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.probe(inst)
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *healthMonitor) probe(inst *instance) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	err := probeInstance(ctx, inst, m.path, 0, m.timeout)
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	if err == nil {
+		if !inst.up {
+			slog.Info("upstream healthy", "instance", inst.target.Host, "failed_probes", inst.probeFailures)
+		}
+		inst.up = true
+		inst.probeFailures = 0
+		return
+	}
+
+	inst.probeFailures++
+	slog.Debug("upstream health probe failed", "instance", inst.target.Host, "failures", inst.probeFailures, "error", err)
+	if inst.up && inst.probeFailures >= m.threshold {
+		inst.up = false
+		slog.Warn("upstream unhealthy", "instance", inst.target.Host, "failures", inst.probeFailures, "error", err)
+	}
+}
+
+// probeInstance sends a GET for path, below the backend's base path, to inst.
+// If expectedStatus is 0, any response below 500 counts as healthy; otherwise
+// the status must match.
+func probeInstance(ctx context.Context, inst *instance, path string, expectedStatus int, timeout time.Duration) error {
+	client := newProbeClient(inst, timeout)
+	return health.HTTPCheck(client, inst.target.JoinPath(path).String(), expectedStatus)(ctx)
+}
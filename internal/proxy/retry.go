@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxBackoffDelay is the maximum delay between retry attempts. It also caps
+// how long an upstream Retry-After is honored when no retry budget is set.
+const maxBackoffDelay = 10 * time.Second
+
+// maxReplayBodySize is the largest request body buffered in memory so that a
+// request can be replayed on retry. Larger bodies get a single attempt.
+const maxReplayBodySize = 1 << 20
+
+// idempotentMethods is the set of HTTP methods that are safe to retry
+// without risk of duplicate side effects on the upstream.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+}
+
+// retryTransport wraps an http.RoundTripper and retries idempotent requests
+// on connection-level errors and, optionally, on selected response status
+// codes. Non-idempotent requests are retried only when they carry an
+// Idempotency-Key header.
+type retryTransport struct {
+	wrapped     http.RoundTripper
+	maxRetries  int
+	baseDelay   time.Duration
+	retryStatus map[int]bool    // response codes worth retrying; empty disables
+	budget      time.Duration   // total time allowed for retries; 0 is unlimited
+	breaker     *circuitBreaker // optional; retries stop once it opens
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetryable(req) {
+		return t.wrapped.RoundTrip(req)
+	}
+
+	// The reverse proxy's outgoing requests have no GetBody, so buffer small
+	// bodies to make them replayable. If the body can't be replayed, fall
+	// back to a single attempt to avoid sending an empty body on retry.
+	if err := makeReplayable(req); err != nil {
+		return nil, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return t.wrapped.RoundTrip(req)
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	// Track which instances have been tried so each retry can move to a
+	// different one.
+	req = req.WithContext(withAttempts(req.Context()))
+
+	// Sanitize the URL for logging: strip query string and fragment to avoid
+	// leaking sensitive parameters into log output.
+	sanitizedURL := *req.URL
+	sanitizedURL.RawQuery = ""
+	sanitizedURL.Fragment = ""
+	logURL := sanitizedURL.String()
+
+	var deadline time.Time
+	if t.budget > 0 {
+		deadline = time.Now().Add(t.budget)
+	}
+
+	for attempt := 0; attempt <= t.maxRetries; attempt++ {
+		// Reset the body before each attempt so retries don't send an empty body.
+		if req.GetBody != nil {
+			body, gbErr := req.GetBody()
+			if gbErr != nil {
+				return nil, gbErr
+			}
+			req.Body = body
+		}
+
+		resp, err = t.wrapped.RoundTrip(req)
+
+		var delay time.Duration
+		switch {
+		case err == nil && !t.retryStatus[resp.StatusCode]:
+			return resp, nil
+		case err == nil:
+			// A retryable status means the upstream is restarting or
+			// overloaded. Honor its Retry-After if it sent one.
+			delay = t.backoff(attempt)
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+		case isConnectionError(err):
+			// Connection-level errors (dial failures, connection refused,
+			// etc.) mean the request never reached the upstream.
+			delay = t.backoff(attempt)
+			// Add ±20% jitter to avoid synchronized retries across instances.
+			delay += time.Duration(float64(delay) * 0.2 * (rand.Float64()*2 - 1))
+		default:
+			return nil, err
+		}
+
+		if attempt == t.maxRetries {
+			break
+		}
+
+		// Another request may have tripped the breaker while this one was
+		// in flight; stop piling retries onto a backend known to be down.
+		if t.breaker != nil && t.breaker.isOpen() {
+			slog.Warn("upstream retries aborted: circuit breaker open",
+				"method", req.Method,
+				"url", logURL,
+				"attempts", attempt+1,
+				"error", err,
+			)
+			return resp, err
+		}
+
+		// Give up early rather than wait past the retry budget, or past
+		// maxBackoffDelay for an upstream asking for a long Retry-After.
+		if (!deadline.IsZero() && time.Now().Add(delay).After(deadline)) ||
+			(deadline.IsZero() && delay > maxBackoffDelay) {
+			slog.Warn("upstream retries stopped: retry budget exceeded",
+				"method", req.Method,
+				"url", logURL,
+				"attempts", attempt+1,
+				"delay", delay,
+			)
+			return resp, err
+		}
+
+		logArgs := []any{
+			"method", req.Method,
+			"url", logURL,
+			"attempt", attempt + 1,
+			"max_retries", t.maxRetries,
+			"attempts_remaining", t.maxRetries - attempt - 1,
+			"delay", delay,
+		}
+		if err != nil {
+			logArgs = append(logArgs, "error", err)
+		} else {
+			logArgs = append(logArgs, "status", resp.StatusCode)
+			drainAndClose(resp.Body)
+		}
+		slog.Warn("retrying upstream", logArgs...)
+
+		// Respect request context cancellation during backoff.
+		select {
+		case <-req.Context().Done():
+			return nil, context.Cause(req.Context())
+		case <-time.After(delay):
+		}
+	}
+
+	if err != nil {
+		slog.Error("upstream retries exhausted",
+			"method", req.Method,
+			"url", logURL,
+			"total_attempts", t.maxRetries+1,
+			"error", err,
+		)
+		return nil, err
+	}
+
+	slog.Error("upstream retries exhausted",
+		"method", req.Method,
+		"url", logURL,
+		"total_attempts", t.maxRetries+1,
+		"status", resp.StatusCode,
+	)
+	return resp, nil
+}
+
+// backoff returns an exponential backoff duration capped at maxBackoffDelay.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	multiplier := math.Pow(2, float64(attempt))
+	delay := time.Duration(float64(t.baseDelay) * multiplier)
+	if delay > maxBackoffDelay {
+		delay = maxBackoffDelay
+	}
+	return delay
+}
+
+// isRetryable reports whether req may be sent more than once: idempotent
+// methods always, anything else only with an Idempotency-Key header, which
+// tells the upstream to deduplicate repeated deliveries.
+func isRetryable(req *http.Request) bool {
+	return idempotentMethods[req.Method] || req.Header.Get("Idempotency-Key") != ""
+}
+
+// makeReplayable buffers a request body of known, small size and sets
+// GetBody so the body can be re-sent on retry.
+func makeReplayable(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		req.Body = nil
+		return nil
+	}
+	if req.GetBody != nil || req.ContentLength < 0 || req.ContentLength > maxReplayBodySize {
+		return nil
+	}
+
+	buf, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After header given either as a number of
+// seconds or as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(time.Until(when), 0), true
+	}
+	return 0, false
+}
+
+// drainAndClose discards a bounded amount of a response body before closing
+// it, so the underlying connection can be reused for the retry.
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
+
+// isConnectionError reports whether err is a connection-level failure
+// (dial error, connection refused, etc.) rather than a higher-level error.
+// errors.As unwraps through any intermediate types (including *url.Error),
+// so this catches raw transport errors that aren't wrapped in *url.Error.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr *net.OpError
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pathRewrite maps public request paths to backend paths: strip is removed
+// from the front of the path, then add is prepended.
+type pathRewrite struct {
+	strip string
+	add   string
+}
+
+// toBackend maps a public path to the backend path.
+func (rw pathRewrite) toBackend(path string) string {
+	if rw.strip != "" && hasPathPrefix(path, rw.strip) {
+		path = path[len(rw.strip):]
+		if path == "" {
+			path = "/"
+		}
+	}
+	return rw.add + path
+}
+
+// toPublic maps a backend path back to the public path.
+func (rw pathRewrite) toPublic(path string) string {
+	if rw.add != "" && hasPathPrefix(path, rw.add) {
+		path = path[len(rw.add):]
+		if path == "" {
+			path = "/"
+		}
+	}
+	return rw.strip + path
+}
+
+// hasPathPrefix reports whether path is prefix or lies beneath it.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// rewriteRequestPath applies the path rewrite to an outgoing request.
+func (rw pathRewrite) rewriteRequestPath(u *url.URL) {
+	if rw == (pathRewrite{}) {
+		return
+	}
+	u.Path = rw.toBackend(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = rw.toBackend(u.RawPath)
+	}
+}
+
+// rewriteResponse maps Location, Content-Location and Set-Cookie back to the
+// public URL, so internal hostnames like *.railway.internal and backend path
+// prefixes never reach the client.
+func (p *Handler) rewriteResponse(resp *http.Response, rw pathRewrite) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(name); value != "" {
+			resp.Header.Set(name, p.rewriteLocation(value, rw, resp.Request))
+		}
+	}
+
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		resp.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			resp.Header.Add("Set-Cookie", p.rewriteCookie(cookie, rw, resp.Request))
+		}
+	}
+}
+
+// rewriteLocation maps a URL sent by the backend to its public equivalent.
+// Absolute URLs pointing at other hosts are left alone.
+func (p *Handler) rewriteLocation(value string, rw pathRewrite, req *http.Request) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+
+	switch {
+	case u.Host != "":
+		if !p.isBackendHost(u.Hostname(), req) {
+			return value
+		}
+		u.Scheme = p.publicURL.Scheme
+		u.Host = p.publicURL.Host
+	case strings.HasPrefix(u.Path, "/"):
+		if rw == (pathRewrite{}) {
+			return value
+		}
+	default:
+		// Relative references resolve correctly on their own.
+		return value
+	}
+
+	u.Path = rw.toPublic(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+// rewriteCookie drops a Domain attribute naming the backend, so the cookie
+// is scoped to the public host, and maps the Path attribute back to the
+// public path. Other attributes are passed through untouched.
+func (p *Handler) rewriteCookie(cookie string, rw pathRewrite, req *http.Request) string {
+	parts := strings.Split(cookie, ";")
+	out := parts[:1]
+	changed := false
+
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case strings.EqualFold(name, "domain") && p.isBackendDomain(value, req):
+			changed = true
+			continue
+		case strings.EqualFold(name, "path") && strings.HasPrefix(value, "/") && rw != (pathRewrite{}):
+			part = " " + name + "=" + rw.toPublic(value)
+			changed = true
+		}
+		out = append(out, part)
+	}
+
+	if !changed {
+		return cookie
+	}
+	return strings.Join(out, ";")
+}
+
+// isBackendHost reports whether host is one of the backend's hostnames: a
+// configured backend, a discovered instance, or the host the request was
+// sent to.
+func (p *Handler) isBackendHost(host string, req *http.Request) bool {
+	for _, candidate := range p.backendHosts(req) {
+		if strings.EqualFold(host, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBackendDomain reports whether a cookie Domain attribute covers one of the
+// backend's hostnames.
+func (p *Handler) isBackendDomain(domain string, req *http.Request) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	for _, candidate := range p.backendHosts(req) {
+		candidate = strings.ToLower(candidate)
+		if candidate == domain || strings.HasSuffix(candidate, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Handler) backendHosts(req *http.Request) []string {
+	hosts := []string{req.URL.Hostname(), hostname(req.Host)}
+	for _, target := range p.pool.targets {
+		hosts = append(hosts, target.Hostname())
+	}
+	for _, inst := range p.pool.list() {
+		hosts = append(hosts, inst.target.Hostname(), hostname(inst.host))
+	}
+	return hosts
+}
+
+// hostname strips the port, if any, from a host[:port] string.
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"turnstile/internal/config"
+)
+
+// routeOptions are the per-route settings applied to each proxied request
+// and its response.
+type routeOptions struct {
+	maxBodySize      int64
+	timeout          time.Duration
+	streamingTimeout time.Duration
+
+	rewrite         pathRewrite
+	requestHeaders  []config.HeaderRules
+	responseHeaders []config.HeaderRules
+}
+
+type routeKey struct{}
+
+// ForRoute returns a handler that proxies through p with route's path
+// rewriting and header rules layered over the top-level ones. Routes use it
+// to share one proxy, and its upstream pool, while handling requests
+// differently.
+func (p *Handler) ForRoute(route config.Route) http.Handler {
+	opts := routeOptions{
+		maxBodySize:      cmp.Or(int64(route.MaxRequestBodySize), p.defaults.maxBodySize),
+		timeout:          cmp.Or(route.UpstreamTimeout, p.defaults.timeout),
+		streamingTimeout: cmp.Or(route.StreamingTimeout, p.defaults.streamingTimeout),
+		rewrite: pathRewrite{
+			strip: cmp.Or(route.StripPrefix, p.defaults.rewrite.strip),
+			add:   cmp.Or(route.AddPrefix, p.defaults.rewrite.add),
+		},
+		requestHeaders:  append(slices.Clip(p.defaults.requestHeaders), route.RequestHeaders),
+		responseHeaders: append(slices.Clip(p.defaults.responseHeaders), route.ResponseHeaders),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, opts)))
+	})
+}
+
+// optionsFor returns the route options for a request.
+func (p *Handler) optionsFor(ctx context.Context) routeOptions {
+	if opts, ok := ctx.Value(routeKey{}).(routeOptions); ok {
+		return opts
+	}
+	return p.defaults
+}
+
+// isStreamingRequest reports whether r opens a long-lived stream: a
+// WebSocket (or other protocol) upgrade or an EventSource (SSE) request.
+func isStreamingRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// modifyResponse is the proxy's ModifyResponse stage: it maps backend URLs
+// and cookies back to the public URL, compresses the body if enabled, then
+// applies the response header rules.
+func (p *Handler) modifyResponse(resp *http.Response) error {
+	opts := p.optionsFor(resp.Request.Context())
+	p.rewriteResponse(resp, opts.rewrite)
+	if p.compressor != nil {
+		p.compressor.compress(resp)
+	}
+	applyHeaderRules(resp.Header, opts.responseHeaders)
+	return nil
+}
+
+// applyHeaderRules applies each set of rules in order: removals, then sets,
+// then adds.
+func applyHeaderRules(h http.Header, rules []config.HeaderRules) {
+	for _, r := range rules {
+		for _, name := range r.Remove {
+			h.Del(name)
+		}
+		for name, value := range r.Set {
+			h.Set(name, value)
+		}
+		for name, value := range r.Add {
+			h.Add(name, value)
+		}
+	}
+}
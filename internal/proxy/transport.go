@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"turnstile/internal/config"
+)
+
+// newUpstreamTransport builds the transport used for every connection to the
+// backend, proxied requests and health probes alike.
+func newUpstreamTransport(u config.Upstream) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CAFile != "" {
+		pem, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream CA file: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream CA file %s: no certificates found", u.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if u.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{
+		Timeout:   u.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	// Most deployments have a single backend, so allow it the whole idle
+	// pool rather than the default two connections per host.
+	transport.MaxIdleConns = u.MaxIdleConns
+	transport.MaxIdleConnsPerHost = u.MaxIdleConns
+	transport.IdleConnTimeout = u.IdleConnTimeout
+	transport.ResponseHeaderTimeout = u.ResponseHeaderTimeout
+	return transport, nil
+}
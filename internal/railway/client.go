@@ -2,6 +2,7 @@ package railway
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -54,6 +55,26 @@ type UserInfo struct {
 	Picture string `json:"picture"`
 }
 
+// Ping checks that the Railway API is reachable. The GraphQL endpoint rejects
+// bare GET requests, so any response below 500 counts as reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (c *Client) FetchUserInfo(accessToken string) (*UserInfo, error) {
 	req, err := http.NewRequest("GET", "https://backboard.railway.com/oauth/me", nil)
 	if err != nil {
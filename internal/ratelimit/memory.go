@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cleanupInterval is how often idle buckets are dropped from memory.
+const cleanupInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// refill adds the tokens earned since the last update.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// memoryStore keeps buckets in process memory. Each replica limits
+// independently.
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{
+		buckets: make(map[string]*bucket),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.cleanup()
+	return s
+}
+
+func (s *memoryStore) Take(_ context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), nil
+}
+
+// cleanup periodically drops full buckets, which are equivalent to missing
+// ones, so memory stays bounded by the number of active clients.
+func (s *memoryStore) cleanup() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, b := range s.buckets {
+				if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+					delete(s.buckets, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *memoryStore) Ping(context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
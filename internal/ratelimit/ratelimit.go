@@ -0,0 +1,129 @@
+// Package ratelimit implements token-bucket rate limiting for HTTP handlers,
+// with buckets kept in memory or, for multi-replica deployments, in Redis.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"turnstile/internal/auth"
+	"turnstile/internal/httpx"
+	"turnstile/internal/problem"
+	"turnstile/internal/views"
+)
+
+// Limit allows Burst requests at once, refilled at Rate requests per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerPeriod returns a limit of n requests per period, allowing all n at
+// once. n <= 0 disables limiting.
+func PerPeriod(n int, period time.Duration) Limit {
+	if n <= 0 || period <= 0 {
+		return Limit{}
+	}
+	return Limit{Rate: float64(n) / period.Seconds(), Burst: n}
+}
+
+func (l Limit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// Store takes tokens from named buckets.
+type Store interface {
+	// Take removes a token from the bucket for key, reporting whether one
+	// was available and, if not, how long until one will be.
+	Take(ctx context.Context, key string, limit Limit) (allowed bool, retryAfter time.Duration, err error)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// KeyFunc returns the bucket key for a request.
+type KeyFunc func(r *http.Request) string
+
+// ByIP keys buckets by client IP.
+func ByIP(r *http.Request) string {
+	return "ip:" + httpx.ClientIP(r)
+}
+
+// ByUser keys buckets by the signed-in user, falling back to the client IP
+// for anonymous requests.
+func ByUser(r *http.Request) string {
+	if sess := auth.GetSessionFromContext(r.Context()); sess != nil {
+		return "user:" + sess.UserID
+	}
+	return ByIP(r)
+}
+
+// Limiter applies limits to handlers, answering limited requests with 429.
+type Limiter struct {
+	store    Store
+	problems *problem.Writer
+}
+
+// New returns a limiter using Redis at redisURL, or memory if it is empty.
+func New(redisURL string, renderer *views.Renderer) (*Limiter, error) {
+	var store Store = newMemoryStore()
+	if redisURL != "" {
+		var err error
+		if store, err = newRedisStore(redisURL); err != nil {
+			return nil, fmt.Errorf("rate limit store: %w", err)
+		}
+	}
+	return &Limiter{store: store, problems: problem.NewWriter(renderer)}, nil
+}
+
+// Middleware limits requests to next per key. name separates the buckets of
+// different handlers. A disabled limit returns next unchanged.
+func (l *Limiter) Middleware(name string, limit Limit, key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !limit.enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, retryAfter, err := l.store.Take(r.Context(), name+":"+key(r), limit)
+			if err != nil {
+				// Fail open: an unavailable store shouldn't take the
+				// service down with it.
+				slog.Warn("rate limit store error, allowing request", "error", err)
+				allowed = true
+			}
+			if !allowed {
+				l.serveLimited(w, r, name, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// serveLimited responds with 429 and a Retry-After hint.
+func (l *Limiter) serveLimited(w http.ResponseWriter, r *http.Request, name string, retryAfter time.Duration) {
+	seconds := max(int((retryAfter+time.Second-1)/time.Second), 1)
+	slog.Warn("rate limited", "limit", name, "path", r.URL.Path, "client_ip", httpx.ClientIP(r), "retry_after", seconds)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	l.problems.Write(w, r, problem.Details{
+		Status:  http.StatusTooManyRequests,
+		Code:    "rate_limited",
+		Detail:  "ratelimit.too_fast",
+		Message: "ratelimit.wait",
+		Args:    []any{seconds},
+	})
+}
+
+// Ping checks the store, for the readiness report.
+func (l *Limiter) Ping(ctx context.Context) error {
+	return l.store.Ping(ctx)
+}
+
+// Close releases the store.
+func (l *Limiter) Close() error {
+	return l.store.Close()
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix namespaces Turnstile's buckets in a shared Redis.
+const keyPrefix = "turnstile:ratelimit:"
+
+// takeScript refills and takes from a bucket atomically, using the Redis
+// server's clock so replicas agree. Buckets expire once they would be full
+// again. It returns whether the request is allowed and, if not, the seconds
+// until a token is available (as a string, since Lua numbers are truncated
+// to integers on return).
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = (1 - tokens) / rate
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(wait)}
+`)
+
+// redisStore keeps buckets in Redis, so all replicas share the same limits.
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(rawURL string) (*redisStore, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *redisStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	res, err := takeScript.Run(ctx, s.client, []string{keyPrefix + key}, limit.Rate, limit.Burst).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	allowed, _ := res[0].(int64)
+	waitStr, _ := res[1].(string)
+	wait, _ := strconv.ParseFloat(waitStr, 64)
+	return allowed == 1, time.Duration(math.Ceil(wait * float64(time.Second))), nil
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
@@ -1,10 +1,12 @@
 package session
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -17,12 +19,25 @@ const (
 )
 
 type Session struct {
+	// ID identifies the session to its user (e.g. in a list of their
+	// devices). Unlike the cookie token, it grants no access.
+	ID string
+
 	UserID      string
 	Email       string
 	Name        string
+	Picture     string
 	AccessToken string
 	ExpiresAt   time.Time
 	CreatedAt   time.Time
+
+	// UserAgent and IP describe the device that signed in.
+	UserAgent string
+	IP        string
+
+	// CSRFToken must accompany state-changing requests to Turnstile's own
+	// endpoints made with this session.
+	CSRFToken string
 }
 
 type Manager struct {
@@ -36,16 +51,28 @@ func NewManager() *Manager {
 	}
 }
 
-func (sm *Manager) CreateSession(userID, email, name, accessToken string) *Session {
+func (sm *Manager) CreateSession(userID, email, name, picture, accessToken string) (*Session, error) {
+	id, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate session ID: %w", err)
+	}
+	csrfToken, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate CSRF token: %w", err)
+	}
+
 	now := time.Now()
 	return &Session{
+		ID:          id,
 		UserID:      userID,
 		Email:       email,
 		Name:        name,
+		Picture:     picture,
 		AccessToken: accessToken,
+		CSRFToken:   csrfToken,
 		ExpiresAt:   now.Add(sessionDuration),
 		CreatedAt:   now,
-	}
+	}, nil
 }
 
 func (sm *Manager) SetSessionCookie(w http.ResponseWriter, r *http.Request, session *Session) error {
@@ -98,13 +125,18 @@ func (sm *Manager) GetSession(r *http.Request) (*Session, error) {
 	return session, nil
 }
 
-func (sm *Manager) ClearSessionCookie(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie(sessionCookieName)
-	if err == nil {
+// DeleteSession ends the request's session, if any, without touching the
+// cookie, e.g. before replacing it with a new one.
+func (sm *Manager) DeleteSession(r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
 		sm.mu.Lock()
 		delete(sm.sessions, cookie.Value)
 		sm.mu.Unlock()
 	}
+}
+
+func (sm *Manager) ClearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	sm.DeleteSession(r)
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
@@ -117,6 +149,46 @@ func (sm *Manager) ClearSessionCookie(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// UserSessions returns the user's unexpired sessions, oldest first.
+func (sm *Manager) UserSessions(userID string) []*Session {
+	now := time.Now()
+
+	sm.mu.RLock()
+	var sessions []*Session
+	for _, session := range sm.sessions {
+		if session.UserID == userID && now.Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	sm.mu.RUnlock()
+
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return sessions
+}
+
+// DeleteUserSessions ends all of the user's sessions, signing them out on
+// every device.
+func (sm *Manager) DeleteUserSessions(userID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for token, session := range sm.sessions {
+		if session.UserID == userID {
+			delete(sm.sessions, token)
+		}
+	}
+}
+
+// Ping reports whether the session store is usable. The in-memory store is
+// always available once the lock can be taken; the method exists so readiness
+// checks don't depend on how sessions are stored.
+func (sm *Manager) Ping(ctx context.Context) error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return ctx.Err()
+}
+
 func generateToken() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
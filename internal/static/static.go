@@ -1,6 +1,33 @@
 package static
 
-import "embed"
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+)
 
-//go:embed index.css
+//go:embed index.css turnstile.js
 var FS embed.FS
+
+// Handler serves the embedded assets. Files in overrideDir, if set, take
+// precedence, so a theme can replace index.css or add a logo.
+func Handler(overrideDir string) http.Handler {
+	var fsys fs.FS = FS
+	if overrideDir != "" {
+		fsys = layeredFS{os.DirFS(overrideDir), FS}
+	}
+	return http.FileServer(http.FS(fsys))
+}
+
+// layeredFS opens files from the first file system that has them.
+type layeredFS []fs.FS
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	for _, fsys := range l[:len(l)-1] {
+		if f, err := fsys.Open(name); err == nil {
+			return f, nil
+		}
+	}
+	return l[len(l)-1].Open(name)
+}
@@ -0,0 +1,172 @@
+/*
+ * Turnstile session helper for single-page apps. Include it from the app:
+ *
+ *   <script src="/_turnstile/static/turnstile.js"></script>
+ *
+ * and use window.Turnstile:
+ *
+ *   Turnstile.status()            resolves to the session status JSON
+ *   Turnstile.refresh({mode})     re-authenticates in a hidden "iframe"
+ *                                 (default) or a "popup"; resolves to true
+ *                                 if the user has a fresh session
+ *   Turnstile.keepAlive(options)  refreshes shortly before the session
+ *                                 expires; returns a function to stop
+ *   Turnstile.fetch(input, init)  like fetch, but re-authenticates and
+ *                                 retries once on a 401
+ */
+(function () {
+	"use strict";
+
+	// Endpoints live next to this script: <prefix>/static/turnstile.js.
+	var script = document.currentScript;
+	var prefix = script
+		? new URL(script.src).pathname.replace(/\/static\/turnstile\.js$/, "")
+		: "/_turnstile";
+	var sessionURL = prefix + "/session";
+	var refreshURL = prefix + "/oauth/refresh";
+
+	var pending = null;
+
+	function status() {
+		return fetch(sessionURL, {
+			credentials: "same-origin",
+			headers: { Accept: "application/json" },
+			cache: "no-store",
+		}).then(function (res) {
+			if (!res.ok) {
+				throw new Error("Turnstile session status: " + res.status);
+			}
+			return res.json();
+		});
+	}
+
+	// waitForResult resolves with the message posted by the silent sign-in
+	// page, or a timeout error.
+	function waitForResult(timeout, cleanup) {
+		return new Promise(function (resolve) {
+			var timer = setTimeout(function () {
+				finish({ ok: false, error: "timeout" });
+			}, timeout);
+
+			function onMessage(event) {
+				if (event.origin !== window.location.origin || !event.data || event.data.type !== "turnstile:auth") {
+					return;
+				}
+				finish(event.data);
+			}
+
+			function finish(result) {
+				clearTimeout(timer);
+				window.removeEventListener("message", onMessage);
+				cleanup();
+				resolve(result);
+			}
+
+			window.addEventListener("message", onMessage);
+		});
+	}
+
+	function refresh(options) {
+		options = options || {};
+		// Concurrent callers share one sign-in.
+		if (pending) {
+			return pending;
+		}
+
+		var mode = options.mode || "iframe";
+		var timeout = options.timeout || (mode === "popup" ? 120000 : 10000);
+		var result;
+
+		if (mode === "popup") {
+			// The user may need to sign in, so the popup is interactive.
+			var popup = window.open(refreshURL + "?interactive=true", "turnstile-auth", "width=520,height=680");
+			if (!popup) {
+				return Promise.resolve(false);
+			}
+			result = waitForResult(timeout, function () {
+				if (!popup.closed) {
+					popup.close();
+				}
+			});
+		} else {
+			var frame = document.createElement("iframe");
+			frame.style.display = "none";
+			frame.setAttribute("aria-hidden", "true");
+			frame.src = refreshURL;
+			document.body.appendChild(frame);
+			result = waitForResult(timeout, function () {
+				frame.remove();
+			});
+		}
+
+		pending = result.then(function (res) {
+			pending = null;
+			return !!res.ok;
+		});
+		return pending;
+	}
+
+	function keepAlive(options) {
+		options = options || {};
+		// Refresh this many seconds before the session expires.
+		var before = options.before || 120;
+		var onExpired = options.onExpired || function () {};
+		var timer = null;
+		var stopped = false;
+
+		function schedule() {
+			status().then(function (s) {
+				if (stopped) {
+					return;
+				}
+				if (!s.authenticated) {
+					onExpired(s);
+					return;
+				}
+				timer = setTimeout(function () {
+					refresh({ mode: "iframe" }).then(function (ok) {
+						if (stopped) {
+							return;
+						}
+						if (ok) {
+							schedule();
+						} else {
+							onExpired(s);
+						}
+					});
+				}, Math.max(s.expires_in - before, 0) * 1000);
+			}).catch(function () {
+				// Try again later, e.g. after a network blip.
+				if (!stopped) {
+					timer = setTimeout(schedule, 30000);
+				}
+			});
+		}
+
+		schedule();
+		return function stop() {
+			stopped = true;
+			clearTimeout(timer);
+		};
+	}
+
+	function turnstileFetch(input, init) {
+		// A Request body can only be read once, so keep a copy to retry with.
+		var retry = input instanceof Request ? input.clone() : input;
+		return fetch(input, init).then(function (res) {
+			if (res.status !== 401 || !res.headers.has("WWW-Authenticate")) {
+				return res;
+			}
+			return refresh({ mode: "iframe" }).then(function (ok) {
+				return ok ? fetch(retry, init) : res;
+			});
+		});
+	}
+
+	window.Turnstile = {
+		status: status,
+		refresh: refresh,
+		keepAlive: keepAlive,
+		fetch: turnstileFetch,
+	};
+})();
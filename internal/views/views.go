@@ -3,27 +3,148 @@ package views
 import (
 	"bytes"
 	"embed"
+	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"turnstile/internal/i18n"
 )
 
 //go:embed *.html
 var templateFS embed.FS
 
-// Renderer holds the parsed template set for all views.
+// Brand customizes the built-in templates; templates read it with the
+// brand function, e.g. {{brand.AppName}}. Empty fields use the defaults.
+type Brand struct {
+	AppName    string
+	LogoURL    string // replaces the page icon
+	Color      string // accent color, e.g. "#0a7cff"
+	SupportURL string // "Contact support" link in the footer
+}
+
+// Renderer holds the parsed template set for all views, once per language.
 type Renderer struct {
-	tmpl       *template.Template
+	tmpls      map[string]*template.Template // by language
+	messages   *i18n.Bundle
 	staticRoot string // e.g. "/_turnstile/static"
 }
 
 // NewRenderer parses all embedded HTML templates and returns a Renderer.
-func NewRenderer(staticRoot string) (*Renderer, error) {
-	tmpl, err := template.ParseFS(templateFS, "*.html")
+// Templates in templateDir, if set, replace the embedded templates and
+// partials of the same name. Every page is rendered once in every language
+// with empty data, so mistakes in overrides are reported at startup rather
+// than to visitors.
+func NewRenderer(staticRoot string, brand Brand, templateDir string, messages *i18n.Bundle) (*Renderer, error) {
+	source := messages.Catalogs()[i18n.Source]
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"brand": func() Brand { return brand },
+	}).Funcs(localeFuncs(source)).ParseFS(templateFS, "*.html")
 	if err != nil {
 		return nil, err
 	}
-	return &Renderer{tmpl: tmpl, staticRoot: staticRoot}, nil
+
+	if templateDir != "" {
+		if tmpl, err = parseOverrides(tmpl, os.DirFS(templateDir)); err != nil {
+			return nil, fmt.Errorf("template overrides in %s: %w", templateDir, err)
+		}
+	}
+
+	r := &Renderer{tmpls: make(map[string]*template.Template), messages: messages, staticRoot: staticRoot}
+	for lang, cat := range messages.Catalogs() {
+		clone, err := tmpl.Clone()
+		if err != nil {
+			return nil, err
+		}
+		r.tmpls[lang] = clone.Funcs(localeFuncs(cat))
+	}
+	for lang, tmpl := range r.tmpls {
+		for name, data := range pages {
+			if err := tmpl.ExecuteTemplate(io.Discard, name, data); err != nil {
+				return nil, fmt.Errorf("%s (%s): %w", name, lang, err)
+			}
+		}
+	}
+	return r, nil
+}
+
+// localeFuncs returns the template functions for localized text:
+//
+//	{{lang}}                            the language, e.g. "de"
+//	{{t "signin.title" .AppName}}       a message from the catalog
+//	{{mono .Email}}                     monospaced text, for use as a t argument
+//	{{link .URL "Turnstile"}}           a link, for use as a t argument
+//	{{formatTime "format.datetime" .T}} a time in the catalog's layout
+func localeFuncs(cat *i18n.Catalog) template.FuncMap {
+	return template.FuncMap{
+		"lang": func() string { return cat.Lang },
+		// The message itself is plain text; only arguments that are already
+		// HTML, such as mono's, are inserted as markup.
+		"t": func(id string, args ...any) template.HTML {
+			msg := template.HTMLEscapeString(cat.T(id))
+			if len(args) == 0 {
+				return template.HTML(msg)
+			}
+			for i, arg := range args {
+				switch a := arg.(type) {
+				case template.HTML:
+					args[i] = string(a)
+				case string:
+					args[i] = template.HTMLEscapeString(a)
+				}
+			}
+			return template.HTML(fmt.Sprintf(msg, args...))
+		},
+		"mono": func(s string) template.HTML {
+			return template.HTML(`<span class="mono">` + template.HTMLEscapeString(s) + `</span>`)
+		},
+		"link": func(url, text string) template.HTML {
+			return template.HTML(`<a href="` + template.HTMLEscapeString(url) + `">` + template.HTMLEscapeString(text) + `</a>`)
+		},
+		"formatTime": func(layoutID string, t time.Time) string {
+			return t.Format(cat.T(layoutID))
+		},
+	}
+}
+
+// Catalog returns the message catalog for the request's Accept-Language.
+func (r *Renderer) Catalog(req *http.Request) *i18n.Catalog {
+	return r.messages.Match(req.Header.Get("Accept-Language"))
+}
+
+// pages maps each page template to an example of its data, for validation.
+var pages = map[string]any{
+	"404.html":    NotFoundPageData{},
+	"error.html":  ErrorPageData{Buttons: []ErrorPageButton{{}}},
+	"waking.html": WakingPageData{},
+	"signin.html": SignInPageData{},
+	"logout.html": LogoutPageData{},
+	"me.html":     MePageData{},
+	"silent.html": SilentAuthPageData{},
+}
+
+// parseOverrides parses the *.html files in dir over tmpl. Each must replace
+// an embedded file (a page or layout.html), so a misspelled name isn't
+// silently ignored.
+func parseOverrides(tmpl *template.Template, dir fs.FS) (*template.Template, error) {
+	files, err := fs.Glob(dir, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if tmpl.Lookup(path.Base(file)) == nil {
+			return nil, fmt.Errorf("%s doesn't replace a built-in template", file)
+		}
+	}
+	if len(files) == 0 {
+		return tmpl, nil
+	}
+	return tmpl.ParseFS(dir, files...)
 }
 
 // NotFoundPageData is the template data for the catch-all route page.
@@ -32,7 +153,10 @@ type NotFoundPageData struct {
 	AuthPrefix string // e.g. "/_turnstile"
 	LoginURL   string
 	LogoutURL  string
+	MeURL      string
+	SessionURL string
 	HealthURL  string
+	ReadyURL   string
 }
 
 // ErrorPageButton is a single action button rendered on an error page.
@@ -50,29 +174,124 @@ type ErrorPageData struct {
 	Message    string // if non-empty, shown in the danger alert box
 	Note       string // if non-empty, shown as an extra paragraph below the alert
 	Buttons    []ErrorPageButton
+	RequestID  string // if non-empty, shown for reference in support requests
+}
+
+// WakingPageData is the template data for the interstitial shown while the
+// backend is down or waking from sleep (waking.html).
+type WakingPageData struct {
+	StaticRoot     string
+	RefreshSeconds int
+}
+
+// SignInPageData is the template data for the sign-in landing page
+// (signin.html).
+type SignInPageData struct {
+	StaticRoot string
+	AppName    string
+	LoginURL   string // starts OAuth, carrying the intended destination
 }
 
-// generic internal function for rendering an HTML template
-func (r *Renderer) renderHTMLTemplate(w http.ResponseWriter, name string, status int, data any) {
+// MePageData is the template data for the account page (me.html).
+type MePageData struct {
+	StaticRoot string
+	Name       string
+	Email      string
+	Picture    string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	Sessions   []SessionItem
+	LogoutURL  string
+	CSRFField  string
+	CSRFToken  string
+}
+
+// SessionItem is one of the user's sessions listed on the account page.
+type SessionItem struct {
+	Device    string // e.g. "Chrome on macOS"
+	IP        string
+	CreatedAt time.Time
+	Current   bool
+}
+
+// LogoutPageData is the template data for the sign-out confirmation page
+// (logout.html).
+type LogoutPageData struct {
+	StaticRoot string
+	Email      string
+	LogoutURL  string
+	CSRFField  string
+	CSRFToken  string
+}
+
+// SilentAuthPageData is the template data for the page that ends a silent
+// re-authentication (silent.html). It reports the result to the window that
+// opened it and closes.
+type SilentAuthPageData struct {
+	StaticRoot   string
+	TargetOrigin string // the only origin the result is posted to
+	OK           bool
+	Error        string // e.g. "login_required"; empty when OK
+	ExpiresAt    time.Time
+}
+
+// generic internal function for rendering an HTML template in the
+// request's language
+func (r *Renderer) renderHTMLTemplate(w http.ResponseWriter, req *http.Request, name string, status int, data any) {
+	lang := r.Catalog(req).Lang
 	var buf bytes.Buffer
-	if err := r.tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+	if err := r.tmpls[lang].ExecuteTemplate(&buf, name, data); err != nil {
 		slog.Error("renderHTMLTemplate: failed to execute template", "template", name, "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
 	w.WriteHeader(status)
 	_, _ = buf.WriteTo(w)
 }
 
 // RenderErrorPage renders error.html with the provided status code and data.
-func (r *Renderer) RenderErrorPage(w http.ResponseWriter, status int, data ErrorPageData) {
+func (r *Renderer) RenderErrorPage(w http.ResponseWriter, req *http.Request, status int, data ErrorPageData) {
 	data.StaticRoot = r.staticRoot
-	r.renderHTMLTemplate(w, "error.html", status, data)
+	r.renderHTMLTemplate(w, req, "error.html", status, data)
 }
 
 // RenderNotFoundPage displays the 404 Not Found error page with metadata about turnstile
-func (r *Renderer) RenderNotFoundPage(w http.ResponseWriter, data NotFoundPageData) {
+func (r *Renderer) RenderNotFoundPage(w http.ResponseWriter, req *http.Request, data NotFoundPageData) {
+	data.StaticRoot = r.staticRoot
+	r.renderHTMLTemplate(w, req, "404.html", http.StatusNotFound, data)
+}
+
+// RenderSignInPage displays the sign-in landing page.
+func (r *Renderer) RenderSignInPage(w http.ResponseWriter, req *http.Request, data SignInPageData) {
+	data.StaticRoot = r.staticRoot
+	r.renderHTMLTemplate(w, req, "signin.html", http.StatusOK, data)
+}
+
+// RenderSilentAuthPage ends a silent re-authentication in a popup or iframe.
+func (r *Renderer) RenderSilentAuthPage(w http.ResponseWriter, req *http.Request, data SilentAuthPageData) {
+	data.StaticRoot = r.staticRoot
+	w.Header().Set("Cache-Control", "no-store")
+	r.renderHTMLTemplate(w, req, "silent.html", http.StatusOK, data)
+}
+
+// RenderMePage displays the account page.
+func (r *Renderer) RenderMePage(w http.ResponseWriter, req *http.Request, data MePageData) {
+	data.StaticRoot = r.staticRoot
+	r.renderHTMLTemplate(w, req, "me.html", http.StatusOK, data)
+}
+
+// RenderLogoutPage displays the sign-out confirmation page.
+func (r *Renderer) RenderLogoutPage(w http.ResponseWriter, req *http.Request, data LogoutPageData) {
+	data.StaticRoot = r.staticRoot
+	r.renderHTMLTemplate(w, req, "logout.html", http.StatusOK, data)
+}
+
+// RenderWakingPage displays the auto-refreshing "waking up your service" page
+// with a 503 status.
+func (r *Renderer) RenderWakingPage(w http.ResponseWriter, req *http.Request, data WakingPageData) {
 	data.StaticRoot = r.staticRoot
-	r.renderHTMLTemplate(w, "404.html", http.StatusNotFound, data)
+	r.renderHTMLTemplate(w, req, "waking.html", http.StatusServiceUnavailable, data)
 }